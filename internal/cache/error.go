@@ -2,12 +2,12 @@ package cache
 
 import (
 	"errors"
-	"os"
+	"io/fs"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 func isNotExistError(err error) bool {
 	var noSuchKeyError *types.NoSuchKey
-	return os.IsNotExist(err) || errors.As(err, &noSuchKeyError)
+	return errors.Is(err, fs.ErrNotExist) || errors.As(err, &noSuchKeyError)
 }
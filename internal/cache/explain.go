@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"os"
+	"slices"
+
+	"github.com/mitchelldw01/omnirepo/internal/graph"
+)
+
+// Describes why a node would miss the cache.
+type Explanation struct {
+	Id    string `json:"id"`
+	Valid bool   `json:"valid"`
+	// True when cache reads were disabled, e.g. with --no-cache or --cache=write-only
+	NoCache bool `json:"noCache"`
+	// IDs of dependencies that would miss the cache
+	InvalidDependencies []string `json:"invalidDependencies"`
+	// True when the node was never cached, or its last cache entry no longer exists
+	MissingCache bool `json:"missingCache"`
+	// The differences from the key of the last cache entry of the node
+	VersionChanged bool `json:"versionChanged"`
+	CommandChanged bool `json:"commandChanged"`
+	OutputsChanged bool `json:"outputsChanged"`
+	// Names of environment variables that were set, unset, or changed
+	EnvChanged []string `json:"envChanged"`
+	// IDs of dependencies whose outputs changed, or whose fingerprints changed when they have no outputs
+	DependenciesChanged []string `json:"dependenciesChanged"`
+	// Paths of input files that were added, removed, or changed
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// Compares the key of a node with the key of its last cache entry.
+// The dependencies of the node must have been validated first.
+func (r *CacheReader) Explain(node *graph.Node, deps map[string]struct{}) (Explanation, error) {
+	expl := Explanation{
+		Id:                  node.Id,
+		NoCache:             r.noCache,
+		InvalidDependencies: r.findInvalidDependencies(deps),
+		EnvChanged:          []string{},
+		DependenciesChanged: []string{},
+		Added:               []string{},
+		Removed:             []string{},
+		Changed:             []string{},
+	}
+
+	fingerprint, err := r.computeFingerprint(node, deps)
+	if err != nil {
+		return Explanation{}, err
+	}
+	_, err = r.getEntry(node, fingerprint)
+	if err != nil && !isNotExistError(err) {
+		return Explanation{}, err
+	}
+	expl.Valid = err == nil && !expl.NoCache && len(expl.InvalidDependencies) == 0
+
+	last, err := r.getLastEntry(node)
+	if err != nil && !isNotExistError(err) {
+		return Explanation{}, err
+	}
+	if isNotExistError(err) {
+		expl.MissingCache = true
+		return expl, nil
+	}
+
+	key, _ := r.keys.get(node.Id)
+	expl.compare(last.taskKey, key)
+	return expl, nil
+}
+
+// Returns the cache entry of a node from the run that last updated the cache.
+func (r *CacheReader) getLastEntry(node *graph.Node) (taskEntry, error) {
+	last, err := r.getLastFingerprints()
+	if err != nil {
+		return taskEntry{}, err
+	}
+
+	fingerprint, ok := last.get(node.Id)
+	if !ok {
+		return taskEntry{}, os.ErrNotExist
+	}
+	return r.getEntry(node, fingerprint)
+}
+
+func (expl *Explanation) compare(prev, curr taskKey) {
+	expl.VersionChanged = prev.Version != curr.Version
+	expl.CommandChanged = prev.Command != curr.Command
+	expl.OutputsChanged = !slices.Equal(prev.Outputs, curr.Outputs)
+
+	added, removed, changed := diffMaps(prev.Env, curr.Env)
+	expl.EnvChanged = concatSorted(added, removed, changed)
+
+	added, removed, changed = diffMaps(prev.Dependencies, curr.Dependencies)
+	expl.DependenciesChanged = concatSorted(added, removed, changed)
+
+	expl.Added, expl.Removed, expl.Changed = diffMaps(prev.Inputs, curr.Inputs)
+}
+
+// Returns the sorted keys that were added, removed, or whose values changed.
+func diffMaps(prev, curr map[string]string) ([]string, []string, []string) {
+	added, removed, changed := []string{}, []string{}, []string{}
+	for key, val := range curr {
+		prevVal, ok := prev[key]
+		if !ok {
+			added = append(added, key)
+		} else if prevVal != val {
+			changed = append(changed, key)
+		}
+	}
+	for key := range prev {
+		if _, ok := curr[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	slices.Sort(added)
+	slices.Sort(removed)
+	slices.Sort(changed)
+	return added, removed, changed
+}
+
+func concatSorted(lists ...[]string) []string {
+	res := []string{}
+	for _, list := range lists {
+		res = append(res, list...)
+	}
+	slices.Sort(res)
+	return res
+}
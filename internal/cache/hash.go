@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/mitchelldw01/omnirepo/internal/log"
 )
 
 // Stateful hasher that will only hash the same file path once.
@@ -35,6 +37,7 @@ func (h *sha256Hasher) hash(paths ...string) ([]string, error) {
 		}
 		h.hashes.put(path, hash)
 		hashes = append(hashes, hash)
+		log.Debug("hashed file", "path", path, "hash", hash)
 	}
 
 	return hashes, nil
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mitchelldw01/omnirepo/internal/log"
+)
+
+// Only stores artifacts that never change, for remote caches that expect every artifact to be immutable,
+// e.g. the artifact API of Turborepo. The indexes of the cache are rewritten by every run, so they're left out,
+// and reading them always misses. The first miss is logged, since the indexes are then only read from the local cache.
+type ImmutableTransport struct {
+	transport Transport
+	warned    *sync.Once
+}
+
+func NewImmutableTransport(t Transport) ImmutableTransport {
+	return ImmutableTransport{transport: t, warned: &sync.Once{}}
+}
+
+func (t ImmutableTransport) Reader(path string) (io.ReadCloser, error) {
+	if !isContentAddressed(path) {
+		t.warned.Do(func() {
+			log.Warn("remote cache doesn't store the cache indexes, so they're empty unless the local cache has them", "path", path)
+		})
+		return nil, fmt.Errorf("failed to read cache artifact %q: %w", path, os.ErrNotExist)
+	}
+	return t.transport.Reader(path)
+}
+
+func (t ImmutableTransport) Writer(path string) (io.WriteCloser, error) {
+	if !isContentAddressed(path) {
+		return nopWriteCloser{io.Discard}, nil
+	}
+	return t.transport.Writer(path)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,79 @@
+package cache_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+	"github.com/mitchelldw01/omnirepo/internal/log"
+)
+
+func TestImmutableTransport(t *testing.T) {
+	testCases := []struct {
+		name   string
+		path   string
+		stored bool
+	}{
+		{name: "should store cache entries", path: "tasks/a.json", stored: true},
+		{name: "should store output archives", path: "outputs/a.tar.zst", stored: true},
+		{name: "should not store the fingerprints index", path: "fingerprints.json"},
+		{name: "should not store the durations index", path: "durations.json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			remote := newMemoryTransport(map[string]string{})
+			trans := cache.NewImmutableTransport(remote)
+
+			w, err := trans.Writer(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte("body")); err != nil {
+				t.Fatalf("failed to write artifact: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := remote.files[tc.path]; ok != tc.stored {
+				t.Fatalf("expected the artifact to be stored to be %v, got %v", tc.stored, ok)
+			}
+
+			r, err := trans.Reader(tc.path)
+			if !tc.stored {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Fatalf("expected a not exist error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if b, err := io.ReadAll(r); err != nil || string(b) != "body" {
+				t.Fatalf("expected %q, got %q: %v", "body", b, err)
+			}
+		})
+	}
+}
+
+func TestImmutableTransportWarning(t *testing.T) {
+	if err := log.SetLevel("warn"); err != nil {
+		t.Fatal(err)
+	}
+	defer log.SetLevel("")
+
+	trans := cache.NewImmutableTransport(newMemoryTransport(map[string]string{}))
+	res := captureStderr(t, func() {
+		for _, path := range []string{"fingerprints.json", "durations.json", "tasks/a.json"} {
+			trans.Reader(path)
+		}
+	})
+
+	if n := strings.Count(res, "doesn't store the cache indexes"); n != 1 {
+		t.Fatalf("expected a single warning about the cache indexes, got %d: %q", n, res)
+	}
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// The version of omni, which is part of every fingerprint so that upgrading omni invalidates the cache.
+var Version = "dev"
+
+// Everything that determines the result of a task. The fingerprint of a task is the hash of its key.
+type taskKey struct {
+	Version string `json:"version"`
+	// The directory that the command runs in, and that the outputs are relative to
+	Dir     string `json:"dir"`
+	Command string `json:"command"`
+	// Patterns matching the output files that are archived with the result
+	Outputs []string `json:"outputs"`
+	// Hashes of the values of the declared environment variables, mapped by name.
+	// Variables that aren't set are left out.
+	Env map[string]string `json:"env"`
+	// Hashes of the input files, mapped by file path
+	Inputs map[string]string `json:"inputs"`
+	// Hashes of the outputs of the dependencies, or their fingerprints when they have no outputs, mapped by node ID
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// Maps are marshaled with sorted keys, so the fingerprint doesn't depend on the order of the inputs.
+func (k taskKey) fingerprint() (string, error) {
+	b, err := json.Marshal(k)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal task key: %v", err)
+	}
+
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// The values of environment variables are hashed so that secrets aren't written to the cache.
+func hashEnv(names []string) map[string]string {
+	env := make(map[string]string, len(names))
+	for _, name := range names {
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		hash := sha256.Sum256([]byte(val))
+		env[name] = hex.EncodeToString(hash[:])
+	}
+	return env
+}
+
+// The cache entry of a task, which is stored by the fingerprint of the task.
+type taskEntry struct {
+	taskKey
+	Result TaskResult `json:"result"`
+	// The hash of the outputs when the result was written, so the outputs of a hit can be hashed before they're restored
+	OutputsHash string `json:"outputsHash,omitempty"`
+}
+
+// Returns the path of a cache entry in the cache.
+func entryPath(fingerprint string) string {
+	return fmt.Sprintf("tasks/%s.json", fingerprint)
+}
+
+// Returns the path of the archive of the outputs of a cache entry in the cache.
+func outputArchivePath(fingerprint string) string {
+	return fmt.Sprintf("outputs/%s.tar.zst", fingerprint)
+}
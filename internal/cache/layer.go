@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/mitchelldw01/omnirepo/internal/log"
+)
+
+// Reads and writes cache artifacts.
+type Transport interface {
+	TransportReader
+	TransportWriter
+}
+
+// A transport that can remove and rename artifacts, so that a download is only visible once it's complete.
+type LocalTransport interface {
+	Transport
+	Remove(path string) error
+	Rename(src, dst string) error
+}
+
+// Puts a local cache in front of a remote cache.
+// Cache entries and output archives are read from the local cache first, and downloaded to it on a miss,
+// so the same artifact is only downloaded once. Artifacts are written to both caches.
+type LayeredTransport struct {
+	local  LocalTransport
+	remote Transport
+}
+
+func NewLayeredTransport(local LocalTransport, remote Transport) LayeredTransport {
+	return LayeredTransport{
+		local:  local,
+		remote: remote,
+	}
+}
+
+// The indexes of the cache are rewritten by every run, so they're read from the remote cache,
+// unless it doesn't store them, e.g. with the artifact API of Turborepo.
+// Everything else is stored by fingerprint and never changes, so it's safe to read from the local cache.
+func (t LayeredTransport) Reader(path string) (io.ReadCloser, error) {
+	if !isContentAddressed(path) {
+		r, err := t.remote.Reader(path)
+		if isNotExistError(err) {
+			return t.local.Reader(path)
+		}
+		return r, err
+	}
+
+	r, err := t.local.Reader(path)
+	if err == nil || !isNotExistError(err) {
+		return r, err
+	}
+
+	r, err = t.remote.Reader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if err := t.download(path, r); err != nil {
+		return nil, err
+	}
+	log.Debug("downloaded to local cache", "path", path)
+	return t.local.Reader(path)
+}
+
+// The artifact is downloaded next to its destination and renamed into place,
+// so concurrent readers never see a partial artifact.
+func (t LayeredTransport) download(path string, r io.Reader) error {
+	tmp := fmt.Sprintf("%s.%016x.tmp", path, rand.Uint64())
+	w, err := t.local.Writer(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	err = errors.Join(err, w.Close())
+	if err == nil {
+		err = t.local.Rename(tmp, path)
+	}
+	if err == nil {
+		return nil
+	}
+
+	if removeErr := t.local.Remove(tmp); removeErr != nil {
+		log.Warn("failed to remove partial download", "path", tmp, "error", removeErr)
+	}
+	return fmt.Errorf("failed to download %q to local cache: %v", path, err)
+}
+
+func (t LayeredTransport) Writer(path string) (io.WriteCloser, error) {
+	local, err := t.local.Writer(path)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := t.remote.Writer(path)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	return &layeredWriteCloser{
+		Writer: io.MultiWriter(local, remote),
+		local:  local,
+		remote: remote,
+	}, nil
+}
+
+type layeredWriteCloser struct {
+	io.Writer
+	local  io.WriteCloser
+	remote io.WriteCloser
+}
+
+func (w *layeredWriteCloser) Close() error {
+	return errors.Join(w.local.Close(), w.remote.Close())
+}
+
+func isContentAddressed(path string) bool {
+	return strings.HasPrefix(path, "tasks/") || strings.HasPrefix(path, "outputs/")
+}
@@ -0,0 +1,171 @@
+package cache_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+)
+
+// Stores artifacts in memory, counts the reads of every path, and records the paths that were written.
+type memoryTransport struct {
+	files   map[string][]byte
+	reads   map[string]int
+	written []string
+}
+
+func newMemoryTransport(files map[string]string) *memoryTransport {
+	t := &memoryTransport{files: map[string][]byte{}, reads: map[string]int{}, written: []string{}}
+	for path, body := range files {
+		t.files[path] = []byte(body)
+	}
+	return t
+}
+
+func (t *memoryTransport) Reader(path string) (io.ReadCloser, error) {
+	t.reads[path]++
+	b, ok := t.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (t *memoryTransport) Writer(path string) (io.WriteCloser, error) {
+	return &memoryWriter{transport: t, path: path}, nil
+}
+
+func (t *memoryTransport) Remove(path string) error {
+	delete(t.files, path)
+	return nil
+}
+
+func (t *memoryTransport) Rename(src, dst string) error {
+	b, ok := t.files[src]
+	if !ok {
+		return os.ErrNotExist
+	}
+	t.files[dst] = b
+	delete(t.files, src)
+	return nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	transport *memoryTransport
+	path      string
+}
+
+func (w *memoryWriter) Close() error {
+	w.transport.files[w.path] = w.Bytes()
+	w.transport.written = append(w.transport.written, w.path)
+	return nil
+}
+
+func TestLayeredTransportReader(t *testing.T) {
+	t.Run("should read from the local cache first", func(t *testing.T) {
+		local := newMemoryTransport(map[string]string{"tasks/a.json": "local"})
+		remote := newMemoryTransport(map[string]string{"tasks/a.json": "remote"})
+
+		if res := readTestArtifact(t, cache.NewLayeredTransport(local, remote), "tasks/a.json"); res != "local" {
+			t.Fatalf("expected %q, got %q", "local", res)
+		}
+		if remote.reads["tasks/a.json"] != 0 {
+			t.Fatal("expected the remote cache not to be read")
+		}
+	})
+
+	t.Run("should download from the remote cache when the local cache misses", func(t *testing.T) {
+		local := newMemoryTransport(map[string]string{})
+		remote := newMemoryTransport(map[string]string{"outputs/a.tar.zst": "remote"})
+		trans := cache.NewLayeredTransport(local, remote)
+
+		for range 2 {
+			if res := readTestArtifact(t, trans, "outputs/a.tar.zst"); res != "remote" {
+				t.Fatalf("expected %q, got %q", "remote", res)
+			}
+		}
+		if string(local.files["outputs/a.tar.zst"]) != "remote" {
+			t.Fatal("expected the artifact to be downloaded to the local cache")
+		}
+		if n := remote.reads["outputs/a.tar.zst"]; n != 1 {
+			t.Fatalf("expected the remote cache to be read once, got %d", n)
+		}
+	})
+
+	t.Run("should rename the download into place", func(t *testing.T) {
+		local := newMemoryTransport(map[string]string{})
+		remote := newMemoryTransport(map[string]string{"outputs/a.tar.zst": "remote"})
+
+		readTestArtifact(t, cache.NewLayeredTransport(local, remote), "outputs/a.tar.zst")
+		if len(local.written) != 1 || local.written[0] == "outputs/a.tar.zst" {
+			t.Fatalf("expected the artifact to be written to a temporary path, got %v", local.written)
+		}
+		if len(local.files) != 1 {
+			t.Fatalf("expected only the downloaded artifact in the local cache, got %d files", len(local.files))
+		}
+	})
+
+	t.Run("should read indexes from the remote cache", func(t *testing.T) {
+		local := newMemoryTransport(map[string]string{"fingerprints.json": "local"})
+		remote := newMemoryTransport(map[string]string{"fingerprints.json": "remote"})
+
+		if res := readTestArtifact(t, cache.NewLayeredTransport(local, remote), "fingerprints.json"); res != "remote" {
+			t.Fatalf("expected %q, got %q", "remote", res)
+		}
+	})
+
+	t.Run("should read indexes from the local cache when the remote cache doesn't have them", func(t *testing.T) {
+		local := newMemoryTransport(map[string]string{"durations.json": "local"})
+		remote := cache.NewImmutableTransport(newMemoryTransport(map[string]string{}))
+
+		if res := readTestArtifact(t, cache.NewLayeredTransport(local, remote), "durations.json"); res != "local" {
+			t.Fatalf("expected %q, got %q", "local", res)
+		}
+	})
+
+	t.Run("should return a not exist error when neither cache has the artifact", func(t *testing.T) {
+		trans := cache.NewLayeredTransport(newMemoryTransport(map[string]string{}), newMemoryTransport(map[string]string{}))
+		if _, err := trans.Reader("tasks/a.json"); !os.IsNotExist(err) {
+			t.Fatalf("expected a not exist error, got %v", err)
+		}
+	})
+}
+
+func TestLayeredTransportWriter(t *testing.T) {
+	local := newMemoryTransport(map[string]string{})
+	remote := newMemoryTransport(map[string]string{})
+
+	w, err := cache.NewLayeredTransport(local, remote).Writer("tasks/a.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("body")); err != nil {
+		t.Fatalf("failed to write artifact: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, trans := range map[string]*memoryTransport{"local": local, "remote": remote} {
+		if res := string(trans.files["tasks/a.json"]); res != "body" {
+			t.Fatalf("expected %q in the %s cache, got %q", "body", name, res)
+		}
+	}
+}
+
+func readTestArtifact(t *testing.T, trans cache.LayeredTransport, path string) string {
+	r, err := trans.Reader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read %q: %v", path, err)
+	}
+	return string(b)
+}
@@ -32,19 +32,6 @@ func (cm *concurrentMap[T]) put(key string, val T) {
 	cm.mutex.Unlock()
 }
 
-func (cm *concurrentMap[T]) contains(keys ...string) bool {
-	cm.mutex.RLock()
-	defer cm.mutex.RUnlock()
-
-	for _, key := range keys {
-		if _, ok := cm.data[key]; !ok {
-			return false
-		}
-	}
-
-	return true
-}
-
 func (cm *concurrentMap[T]) loadFromReader(r io.Reader) error {
 	b, err := io.ReadAll(r)
 	if err != nil {
@@ -88,6 +75,26 @@ func (ncm *nestedConcurrentMap[T]) getOrPut(key string) (*concurrentMap[T], bool
 	return val, ok
 }
 
+// Removes a key from a nested map, and removes the nested map once it's empty.
+func (ncm *nestedConcurrentMap[T]) remove(key, nestedKey string) {
+	ncm.mutex.Lock()
+	defer ncm.mutex.Unlock()
+
+	val, ok := ncm.data[key]
+	if !ok {
+		return
+	}
+
+	val.mutex.Lock()
+	delete(val.data, nestedKey)
+	empty := len(val.data) == 0
+	val.mutex.Unlock()
+
+	if empty {
+		delete(ncm.data, key)
+	}
+}
+
 func (ncm *nestedConcurrentMap[T]) toUnsafeMap() map[string]map[string]T {
 	hashMap := map[string]map[string]T{}
 	for key, val := range ncm.data {
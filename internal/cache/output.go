@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Copies the files matching the output patterns in the target directory to the destination.
+// The copies keep their paths relative to the target directory.
+func copyOutputs(dir string, patterns []string, dst string) error {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory %q: %v", dst, err)
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	paths, err := getCacheableOutputPaths(dir, patterns)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return fmt.Errorf("failed to determine relative file path from %q to %q: %v", dir, path, err)
+		}
+		if err := copyFile(path, filepath.Join(dst, rel)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Hashes the paths and contents of the files matching the output patterns in the target directory.
+// A fresh hasher is used, because the outputs may have changed since the files were last hashed.
+func hashOutputs(dir string, patterns []string) (string, error) {
+	paths, err := getCacheableOutputPaths(dir, patterns)
+	if err != nil {
+		return "", err
+	}
+	hashes, err := newSha256Hasher().hash(paths...)
+	if err != nil {
+		return "", err
+	}
+
+	outputs := make(map[string]string, len(paths))
+	for i, path := range paths {
+		outputs[path] = hashes[i]
+	}
+	b, err := json.Marshal(outputs)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal output hashes: %v", err)
+	}
+
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func copyDirectory(src, dst string) error {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %v", dst, err)
+	}
+
+	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to walk directory %q: %v", src, err)
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return fmt.Errorf("failed to determine relative file path from %q to %q: %v", src, path, err)
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			if err := os.MkdirAll(dstPath, 0o755); err != nil {
+				return fmt.Errorf("failed to create directory %q: %v", dstPath, err)
+			}
+			return nil
+		}
+
+		return copyFile(path, dstPath)
+	})
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %v", dst, err)
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q: %v", src, err)
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create file %q: %v", dst, err)
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return fmt.Errorf("failed to copy %q to %q: %v", src, dst, err)
+	}
+
+	return nil
+}
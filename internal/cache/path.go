@@ -39,16 +39,7 @@ func getCacheableTargetPaths(dir string, includes, excludes []string) ([]string,
 			return fmt.Errorf("failed to walk directory %q: %v", dir, err)
 		}
 
-		normalized := filepath.Join(strings.Split(path, string(filepath.Separator))[1:]...)
-		isMatch, err := checkForMatch(normalized, excludes)
-		if err != nil {
-			return err
-		}
-		if isMatch {
-			return nil
-		}
-
-		isMatch, err = checkForMatch(normalized, includes)
+		isMatch, err := matchTargetPath(path, includes, excludes)
 		if err != nil {
 			return err
 		}
@@ -60,12 +51,27 @@ func getCacheableTargetPaths(dir string, includes, excludes []string) ([]string,
 	})
 }
 
+// Patterns are matched against the path relative to its target directory.
+func matchTargetPath(path string, includes, excludes []string) (bool, error) {
+	normalized := filepath.Join(strings.Split(path, string(filepath.Separator))[1:]...)
+	isMatch, err := checkForMatch(normalized, excludes)
+	if err != nil || isMatch {
+		return false, err
+	}
+
+	return checkForMatch(normalized, includes)
+}
+
+// Directories aren't outputs themselves, even when a pattern like dist/** matches them.
 func getCacheableOutputPaths(dir string, patterns []string) ([]string, error) {
 	paths := []string{}
 	return paths, filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("failed to walk directory %q: %v", dir, err)
 		}
+		if info.IsDir() {
+			return nil
+		}
 
 		normalized := filepath.Join(strings.Split(path, string(filepath.Separator))[1:]...)
 		isMatch, err := checkForMatch(normalized, patterns)
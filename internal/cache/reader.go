@@ -4,12 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/mitchelldw01/omnirepo/internal/graph"
+	"github.com/mitchelldw01/omnirepo/internal/log"
 	"github.com/mitchelldw01/omnirepo/usercfg"
 )
 
@@ -25,18 +29,35 @@ type CacheReader struct {
 	targets       []string
 	hasher        *sha256Hasher
 	// The temporary directory that the existing cache will be extracted to.
-	tmpCache string
-	// Map from target directories to the ouput patterns for every node
-	outputs *concurrentMap[[]string]
-	// Map of hashes of cache inputs in the workspace cache
-	workCache *concurrentMap[struct{}]
-	// Map from target directories to hashes of cache inputs
-	targetCache *nestedConcurrentMap[struct{}]
+	tmpCache *tmpDir
+	// Map from fingerprints to their extracted output archives
+	archives *concurrentMap[*outputArchive]
 	// Map from node directories to node names
 	invalidNodes *nestedConcurrentMap[struct{}]
-	// Ensures thread-safe initializion of the workspace cache
-	initWorkLock sync.Mutex
-	noCache      bool
+	// Map from node IDs to the durations of their tasks in previous runs
+	durations *concurrentMap[time.Duration]
+	// Map from node IDs to their fingerprints
+	fingerprints *concurrentMap[string]
+	// Map from node IDs to the hashes of their outputs, which are computed once they've finished
+	outputHashes *concurrentMap[string]
+	// Map from node IDs to the keys that their fingerprints were computed from
+	keys *concurrentMap[taskKey]
+	// Map from node IDs to the cache entries of nodes that hit the cache
+	entries *concurrentMap[taskEntry]
+	// Map from node IDs to their fingerprints in the runs that last updated the cache
+	lastFingerprints *concurrentMap[string]
+	// Ensures the last fingerprints are only read once
+	lastFingerprintsOnce sync.Once
+	lastFingerprintsErr  error
+	noCache              bool
+	// Hits only require their output archives to exist, because the outputs are never restored
+	validateOnly bool
+}
+
+// An output archive is extracted once, even when nodes with the same fingerprint are validated concurrently.
+type outputArchive struct {
+	once sync.Once
+	err  error
 }
 
 func NewCacheReader(
@@ -51,46 +72,82 @@ func NewCacheReader(
 	}
 
 	return &CacheReader{
-		transport:     tr,
-		targetConfigs: configs,
-		targets:       cleaned,
-		hasher:        newSha256Hasher(),
-		tmpCache:      filepath.Join(os.TempDir(), "omni-prev-cache"),
-		outputs:       newConcurrentMap[[]string](),
-		targetCache:   newNestedConcurrentMap[struct{}](),
-		invalidNodes:  newNestedConcurrentMap[struct{}](),
-		initWorkLock:  sync.Mutex{},
-		noCache:       noCache,
+		transport:        timedTransportReader{tr},
+		targetConfigs:    configs,
+		targets:          cleaned,
+		hasher:           newSha256Hasher(),
+		tmpCache:         newTmpDir("omni-prev-cache-"),
+		archives:         newConcurrentMap[*outputArchive](),
+		invalidNodes:     newNestedConcurrentMap[struct{}](),
+		durations:        newConcurrentMap[time.Duration](),
+		fingerprints:     newConcurrentMap[string](),
+		outputHashes:     newConcurrentMap[string](),
+		keys:             newConcurrentMap[taskKey](),
+		entries:          newConcurrentMap[taskEntry](),
+		lastFingerprints: newConcurrentMap[string](),
+		noCache:          noCache,
 	}
 }
 
+// Stops hits from downloading their output archives, for commands that never restore outputs.
+func (r *CacheReader) ValidateOnly() {
+	r.validateOnly = true
+}
+
+// Removes the outputs that were extracted from the cache. Outputs can't be restored afterwards.
+func (r *CacheReader) Cleanup() error {
+	return r.tmpCache.remove()
+}
+
+// Returns the cached result of a node that hit the cache.
 func (r *CacheReader) GetCachedResult(dir, name string) (TaskResult, error) {
-	path := filepath.Join(r.tmpCache, dir, "results", name+".json")
-	b, err := os.ReadFile(path)
+	id := fmt.Sprintf("%s:%s", dir, name)
+	entry, ok := r.entries.get(id)
+	if !ok {
+		return TaskResult{}, fmt.Errorf("failed to read task result: %q has no cache entry", id)
+	}
+	return entry.Result, nil
+}
+
+// Returns the durations of tasks from previous runs, mapped by node ID.
+// An empty map is returned when no durations have been recorded yet.
+func (r *CacheReader) GetDurations() (map[string]time.Duration, error) {
+	tr, err := r.transport.Reader("durations.json")
 	if err != nil {
-		return TaskResult{}, fmt.Errorf("failed to read task result %q: %v", path, err)
+		if isNotExistError(err) {
+			return map[string]time.Duration{}, nil
+		}
+		return nil, err
 	}
+	defer tr.Close()
 
-	var res TaskResult
-	if err := json.Unmarshal(b, &res); err != nil {
-		return TaskResult{}, fmt.Errorf("failed to unmarshal task result: %v", err)
+	if err := r.durations.loadFromReader(tr); err != nil {
+		return nil, err
 	}
 
-	return res, nil
+	r.durations.mutex.RLock()
+	defer r.durations.mutex.RUnlock()
+	return maps.Clone(r.durations.data), nil
 }
 
+// The dependencies of the node must have finished first, because their outputs are part of its fingerprint.
 func (r *CacheReader) Validate(node *graph.Node, deps map[string]struct{}) (bool, error) {
-	r.outputs.mutex.Lock()
-	if r.outputs.data[node.Dir] == nil {
-		r.outputs.data[node.Dir] = []string{}
+	span := node.Span.Start("cache.validate")
+	defer span.End()
+
+	fingerprint, err := r.computeFingerprint(node, deps)
+	if err != nil {
+		return false, err
 	}
-	r.outputs.data[node.Dir] = append(r.outputs.data[node.Dir], node.Pipeline.Outputs...)
-	r.outputs.mutex.Unlock()
 
 	var valid bool
-	var err error
-	if !r.noCache {
-		valid, err = r.validateAll(node, deps)
+	if r.noCache {
+		log.Debug("cache miss", "task", node.Id, "reason", "cache reads are disabled")
+	} else {
+		valid, err = r.validateAll(node, fingerprint)
+	}
+	if valid {
+		log.Debug("cache hit", "task", node.Id, "fingerprint", fingerprint)
 	}
 	if !valid {
 		nameSet, _ := r.invalidNodes.getOrPut(node.Dir)
@@ -100,140 +157,308 @@ func (r *CacheReader) Validate(node *graph.Node, deps map[string]struct{}) (bool
 	return valid, err
 }
 
-func (r *CacheReader) validateAll(node *graph.Node, deps map[string]struct{}) (bool, error) {
-	if r.hasInvalidDependency(deps) {
-		return false, nil
-	}
+// Removes a node from the invalid nodes, so that the cache isn't updated for a node without a result,
+// e.g. a task that was killed because another task failed.
+func (r *CacheReader) Discard(node *graph.Node) {
+	r.invalidNodes.remove(node.Dir, node.Name)
+}
+
+// Computes the fingerprint of a node from its key, which includes the outputs of its dependencies.
+func (r *CacheReader) computeFingerprint(node *graph.Node, deps map[string]struct{}) (string, error) {
+	span := node.Span.Start("cache.hash")
+	defer span.End()
 
-	isWorkClean, err := r.validateWorkspace(node.Dir)
+	inputs, err := r.hashInputs(node)
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	if !isWorkClean {
-		return false, nil
+	span.SetAttribute("files", len(inputs))
+
+	depHashes := make(map[string]string, len(deps))
+	for id := range deps {
+		hash, err := r.hashDependency(id)
+		if err != nil {
+			return "", fmt.Errorf("failed to compute fingerprint of %q: %v", node.Id, err)
+		}
+		depHashes[id] = hash
+	}
+
+	key := taskKey{
+		Version:      Version,
+		Dir:          node.Dir,
+		Command:      node.Pipeline.Command,
+		Outputs:      node.Pipeline.Outputs,
+		Env:          hashEnv(node.Pipeline.Env),
+		Inputs:       inputs,
+		Dependencies: depHashes,
+	}
+	fingerprint, err := key.fingerprint()
+	if err != nil {
+		return "", err
 	}
 
-	return r.validateTarget(node)
+	r.keys.put(node.Id, key)
+	r.fingerprints.put(node.Id, fingerprint)
+	log.Debug("computed fingerprint", "task", node.Id, "fingerprint", fingerprint)
+	return fingerprint, nil
 }
 
-func (r *CacheReader) hasInvalidDependency(deps map[string]struct{}) bool {
-	for id := range deps {
-		index := strings.LastIndex(id, ":")
-		dir, name := id[:index], id[index+1:]
+// Dependents are keyed on the outputs of a dependency rather than its fingerprint,
+// so a dependency that executes again but produces identical outputs doesn't invalidate them.
+// A dependency without outputs is keyed on its fingerprint, since nothing else describes its result.
+// The outputs of a hit are hashed from its cache entry, because they may not have been restored yet, e.g. in a dry run.
+func (r *CacheReader) hashDependency(id string) (string, error) {
+	if hash, ok := r.outputHashes.get(id); ok {
+		return hash, nil
+	}
 
-		connMap, ok := r.invalidNodes.get(dir)
-		if !ok {
-			continue
-		}
-		_, ok = connMap.get(name)
-		if ok {
-			return true
-		}
+	key, ok := r.keys.get(id)
+	if !ok {
+		return "", fmt.Errorf("dependency %q has not been validated", id)
+	}
+	if len(key.Outputs) == 0 {
+		fingerprint, _ := r.fingerprints.get(id)
+		return fingerprint, nil
 	}
-	return false
+
+	hash, err := hashOutputs(key.Dir, key.Outputs)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash outputs of dependency %q: %v", id, err)
+	}
+	r.outputHashes.put(id, hash)
+	log.Debug("hashed outputs", "task", id, "hash", hash)
+	return hash, nil
 }
 
-func (r *CacheReader) validateWorkspace(dir string) (bool, error) {
-	workAssets := r.targetConfigs[dir].WorkspaceAssets
-	paths, err := getCacheableWorkspacePaths(workAssets, r.targets)
+// Returns the hashes of the workspace and target inputs of a node, mapped by file path.
+func (r *CacheReader) hashInputs(node *graph.Node) (map[string]string, error) {
+	workPaths, err := getCacheableWorkspacePaths(r.targetConfigs[node.Dir].WorkspaceAssets, r.targets)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	targetPaths, err := getCacheableTargetPaths(node.Dir, node.Pipeline.Includes, node.Pipeline.Excludes)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("walked inputs", "task", node.Id, "workspace", workPaths, "target", targetPaths)
+
+	paths := append(workPaths, targetPaths...)
+	hashes, err := r.hasher.hash(paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make(map[string]string, len(paths))
+	for i, path := range paths {
+		inputs[path] = hashes[i]
+	}
+	return inputs, nil
+}
 
-	connMap, err := r.getWorkspaceCache()
-	if err != nil && !isNotExistError(err) {
+// Returns the fingerprint of a node that has been validated.
+func (r *CacheReader) GetFingerprint(node *graph.Node) string {
+	fingerprint, _ := r.fingerprints.get(node.Id)
+	return fingerprint
+}
+
+// Returns the hashes of the inputs of a node that has been validated, mapped by file path.
+func (r *CacheReader) GetInputs(node *graph.Node) map[string]string {
+	key, _ := r.keys.get(node.Id)
+	return key.Inputs
+}
+
+// Returns the paths of the files that match the output patterns of a node.
+func (r *CacheReader) GetOutputs(node *graph.Node) ([]string, error) {
+	if len(node.Pipeline.Outputs) == 0 {
+		return []string{}, nil
+	}
+	return getCacheableOutputPaths(node.Dir, node.Pipeline.Outputs)
+}
+
+func (r *CacheReader) validateAll(node *graph.Node, fingerprint string) (bool, error) {
+	entry, err := r.getEntry(node, fingerprint)
+	if isNotExistError(err) {
+		log.Debug("cache miss", "task", node.Id, "reason", "no cache entry for fingerprint", "fingerprint", fingerprint)
+		return false, nil
+	}
+	if err != nil {
 		return false, err
 	}
-	if len(paths) == 0 {
+
+	// A hit is useless when its outputs can't be restored, so the archive is downloaded up front
+	if len(node.Pipeline.Outputs) > 0 {
+		var err error
+		if r.validateOnly {
+			err = r.checkOutputArchive(fingerprint)
+		} else {
+			err = r.unpackOutputArchive(node, fingerprint)
+		}
 		if isNotExistError(err) {
+			log.Warn("cache entry has no output archive", "task", node.Id, "fingerprint", fingerprint)
+			log.Debug("cache miss", "task", node.Id, "reason", "output archive missing", "fingerprint", fingerprint)
 			return false, nil
 		}
-		return true, nil
+		if err != nil {
+			return false, err
+		}
 	}
 
-	return r.mapContainsHashes(connMap, paths)
+	r.entries.put(node.Id, entry)
+	if entry.OutputsHash != "" {
+		r.outputHashes.put(node.Id, entry.OutputsHash)
+	}
+	return true, nil
 }
 
-func (r *CacheReader) getWorkspaceCache() (*concurrentMap[struct{}], error) {
-	r.initWorkLock.Lock()
-	defer r.initWorkLock.Unlock()
+// Returns the sorted IDs of the dependencies that missed the cache.
+func (r *CacheReader) findInvalidDependencies(deps map[string]struct{}) []string {
+	invalid := []string{}
+	for id := range deps {
+		index := strings.LastIndex(id, ":")
+		dir, name := id[:index], id[index+1:]
 
-	if r.workCache != nil {
-		return r.workCache, nil
+		connMap, ok := r.invalidNodes.get(dir)
+		if !ok {
+			continue
+		}
+		if _, ok := connMap.get(name); ok {
+			invalid = append(invalid, id)
+		}
 	}
 
-	connMap := newConcurrentMap[struct{}]()
-	r.workCache = connMap
+	slices.Sort(invalid)
+	return invalid
+}
+
+// Reads the cache entry with the given fingerprint.
+func (r *CacheReader) getEntry(node *graph.Node, fingerprint string) (taskEntry, error) {
+	span := node.Span.Start("cache.download")
+	defer span.End()
 
-	tr, err := r.transport.Reader("workspace.json")
+	path := entryPath(fingerprint)
+	tr, err := r.transport.Reader(path)
 	if err != nil {
-		return connMap, err
+		return taskEntry{}, err
 	}
 	defer tr.Close()
 
-	return connMap, connMap.loadFromReader(tr)
+	var entry taskEntry
+	if err := json.NewDecoder(tr).Decode(&entry); err != nil {
+		return taskEntry{}, fmt.Errorf("failed to read cache entry %q: %v", path, err)
+	}
+	return entry, nil
 }
 
-func (r *CacheReader) validateTarget(node *graph.Node) (bool, error) {
-	paths, err := getCacheableTargetPaths(node.Dir, node.Pipeline.Includes, node.Pipeline.Excludes)
-	if err != nil {
-		return false, err
+// Returns the fingerprints of nodes in the runs that last updated the cache, mapped by node ID.
+func (r *CacheReader) getLastFingerprints() (*concurrentMap[string], error) {
+	r.lastFingerprintsOnce.Do(func() {
+		tr, err := r.transport.Reader("fingerprints.json")
+		if err != nil {
+			if !isNotExistError(err) {
+				r.lastFingerprintsErr = err
+			}
+			return
+		}
+		defer tr.Close()
+
+		r.lastFingerprintsErr = r.lastFingerprints.loadFromReader(tr)
+	})
+
+	return r.lastFingerprints, r.lastFingerprintsErr
+}
+
+// Restores the cached outputs of a node that hit the cache to its target directory.
+func (r *CacheReader) RestoreOutputs(node *graph.Node) error {
+	if len(node.Pipeline.Outputs) == 0 {
+		return nil
 	}
 
-	connMap, err := r.getTargetCache(node.Dir)
-	if err != nil && !isNotExistError(err) {
-		return false, err
+	span := node.Span.Start("cache.restore")
+	defer span.End()
+
+	tmp, err := r.tmpCache.get()
+	if err != nil {
+		return err
 	}
-	if len(paths) == 0 {
-		if isNotExistError(err) {
-			return false, nil
-		}
-		return true, nil
+	fingerprint, _ := r.fingerprints.get(node.Id)
+	src := filepath.Join(tmp, fingerprint)
+	if err := copyDirectory(src, node.Dir); err != nil {
+		return fmt.Errorf("failed to restore cached outputs of %q: %v", node.Id, err)
 	}
-
-	return r.mapContainsHashes(connMap, paths)
+	return nil
 }
 
-func (r *CacheReader) getTargetCache(dir string) (*concurrentMap[struct{}], error) {
-	connMap, ok := r.targetCache.getOrPut(dir)
-	if ok {
-		return connMap, nil
+func (r *CacheReader) unpackOutputArchive(node *graph.Node, fingerprint string) error {
+	r.archives.mutex.Lock()
+	archive, ok := r.archives.data[fingerprint]
+	if !ok {
+		archive = &outputArchive{}
+		r.archives.data[fingerprint] = archive
 	}
+	r.archives.mutex.Unlock()
+
+	archive.once.Do(func() {
+		archive.err = r.unpackOutputArchiveHelper(node, fingerprint)
+	})
+	return archive.err
+}
 
-	dst, err := r.unpackTargetCache(dir)
+func (r *CacheReader) unpackOutputArchiveHelper(node *graph.Node, fingerprint string) error {
+	tmp, err := r.tmpCache.get()
 	if err != nil {
-		return connMap, err
+		return err
+	}
+	dst := filepath.Join(tmp, fingerprint)
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory %q: %v", dst, err)
 	}
 
-	path := filepath.Join(dst, "inputs.json")
-	file, err := os.Open(path)
+	span := node.Span.Start("cache.download")
+	archive, err := r.downloadOutputArchive(fingerprint)
+	span.End()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read cache artifact %q: %v", path, err)
+		return err
 	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
 
-	return connMap, connMap.loadFromReader(file)
+	span = node.Span.Start("cache.unpack")
+	defer span.End()
+	return unpackTarZst(archive, dst)
 }
 
-func (r *CacheReader) unpackTargetCache(dir string) (string, error) {
-	dst := filepath.Join(r.tmpCache, dir)
-	if err := os.MkdirAll(dst, 0o755); err != nil {
-		return "", fmt.Errorf("failed to create cache directory %q: %v", dst, err)
+// The archive is opened without being read, which is enough to tell that it exists.
+func (r *CacheReader) checkOutputArchive(fingerprint string) error {
+	tr, err := r.transport.Reader(outputArchivePath(fingerprint))
+	if err != nil {
+		return err
 	}
+	return tr.Close()
+}
 
-	src := fmt.Sprintf("%s-meta.tar.zst", dir)
-	tr, err := r.transport.Reader(src)
+// Transports stream the body of an artifact as it's read, so the archive is downloaded to a temporary file
+// before it's unpacked. Otherwise the download would be timed as part of unpacking.
+func (r *CacheReader) downloadOutputArchive(fingerprint string) (*os.File, error) {
+	path := outputArchivePath(fingerprint)
+	tr, err := r.transport.Reader(path)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer tr.Close()
 
-	return dst, unpackTarZst(tr, dst)
-}
-
-func (r *CacheReader) mapContainsHashes(connMap *concurrentMap[struct{}], paths []string) (bool, error) {
-	hashes, err := r.hasher.hash(paths...)
+	file, err := os.CreateTemp("", "omni-archive-")
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("failed to download cache artifact %q: %v", path, err)
+	}
+	if _, err := io.Copy(file, tr); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to download cache artifact %q: %w", path, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to download cache artifact %q: %v", path, err)
 	}
-	return connMap.contains(hashes...), nil
+	return file, nil
 }
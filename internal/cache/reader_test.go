@@ -1,248 +1,812 @@
 package cache_test
 
 import (
-	"encoding/json"
-	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/mitchelldw01/omnirepo/internal/cache"
 	"github.com/mitchelldw01/omnirepo/internal/graph"
-	"github.com/mitchelldw01/omnirepo/internal/service/sys"
+	"github.com/mitchelldw01/omnirepo/internal/log"
+	"github.com/mitchelldw01/omnirepo/internal/trace"
 	"github.com/mitchelldw01/omnirepo/usercfg"
 )
 
 func TestGetCachedResult(t *testing.T) {
-	prev, err := createPrevCacheDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
+
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Logf("failed to reset working directory: %v", err)
+		}
+	}()
+
+	work, err := createTestWorkspace()
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(prev)
+	defer os.RemoveAll(work)
 
-	dir, name := "dir", "name"
-	exp := cache.NewTaskResult("logs", false)
-	if err := createTestTaskResult(prev, dir, name, exp); err != nil {
+	if _, err := populateTestCache(node); err != nil {
 		t.Fatal(err)
 	}
 
-	trans := sys.NewSystemTransport()
-	cr := cache.NewCacheReader(trans, map[string]usercfg.TargetConfig{}, []string{}, false)
-	res, err := cr.GetCachedResult(dir, name)
+	cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
+	defer cr.Cleanup()
+	if _, err := validateTestNode(cr, node); err != nil {
+		t.Fatal(err)
+	}
+	res, err := cr.GetCachedResult(node.Dir, node.Name)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if !reflect.DeepEqual(exp, res) {
-		t.Fatalf("expected %v, got %v", exp, res)
+	if !reflect.DeepEqual(testResult, res) {
+		t.Fatalf("expected %v, got %v", testResult, res)
 	}
 }
 
-func TestValidate(t *testing.T) {
+func TestRestoreOutputs(t *testing.T) {
 	wd, err := os.Getwd()
 	if err != nil {
 		t.Fatalf("failed to get current directory: %v", err)
 	}
 
-	t.Run("should return true when the cache is valid", func(t *testing.T) {
-		prev, err := createPrevCacheDir()
-		if err != nil {
-			t.Fatal(err)
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Logf("failed to reset working directory: %v", err)
 		}
-		defer os.RemoveAll(prev)
-		defer func() {
-			if err := os.Chdir(wd); err != nil {
-				t.Logf("failed to reset working directory: %v", err)
-			}
-		}()
+	}()
 
-		work, err := createTestWorkspace()
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer os.RemoveAll(work)
+	work, err := createTestWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
 
-		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
-		valid, err := cr.Validate(node, deps)
-		if err != nil {
-			t.Fatal(err)
-		}
+	if _, err := populateTestCache(node); err != nil {
+		t.Fatal(err)
+	}
+
+	cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
+	defer cr.Cleanup()
+	if valid, err := validateTestNode(cr, node); err != nil || !valid {
+		t.Fatalf("expected a cache hit, got %v: %v", valid, err)
+	}
 
-		if valid != true {
-			t.Fatalf("expected %v, got %v", true, valid)
+	// remove task output to test that it gets restored
+	output := filepath.Join(work, "foo/output.txt")
+	if err := os.Remove(output); err != nil {
+		t.Fatalf("failed to remove %q: %v", output, err)
+	}
+
+	if err := cr.RestoreOutputs(node); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(output); os.IsNotExist(err) {
+		t.Fatalf("expected %q to exist", output)
+	}
+}
+
+// Delays every read of output archives, like a transport that streams them from a remote cache.
+type slowTransport struct {
+	cache.TransportReader
+	delay time.Duration
+}
+
+func (t slowTransport) Reader(path string) (io.ReadCloser, error) {
+	rc, err := t.TransportReader.Reader(path)
+	if err != nil || !strings.HasPrefix(path, "outputs/") {
+		return rc, err
+	}
+	return slowReader{ReadCloser: rc, delay: t.delay}, nil
+}
+
+type slowReader struct {
+	io.ReadCloser
+	delay time.Duration
+}
+
+func (r slowReader) Read(b []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.ReadCloser.Read(b)
+}
+
+type spanExporter struct {
+	spans []trace.SpanData
+}
+
+func (e *spanExporter) Export(spans []trace.SpanData) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestDownloadSpan(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
+
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Logf("failed to reset working directory: %v", err)
 		}
-	})
+	}()
 
-	t.Run("should return false when the workspace cache is invalid", func(t *testing.T) {
-		prev, err := createPrevCacheDir()
-		if err != nil {
-			t.Fatal(err)
+	work, err := createTestWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+
+	if _, err := populateTestCache(node); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &spanExporter{}
+	trace.Enable(exp)
+	tracedNode := graph.NewNode(node.Name, node.Dir, node.Pipeline)
+	tracedNode.Span = trace.StartRun("test")
+
+	delay := 50 * time.Millisecond
+	cr := cache.NewCacheReader(slowTransport{TransportReader: trans, delay: delay}, configs, []string{"foo", "bar"}, false)
+	defer cr.Cleanup()
+	if valid, err := validateTestNode(cr, tracedNode); err != nil || !valid {
+		t.Fatalf("expected a cache hit, got %v: %v", valid, err)
+	}
+	if err := cr.RestoreOutputs(tracedNode); err != nil {
+		t.Fatal(err)
+	}
+	if err := trace.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, span := range exp.spans {
+		if span.Name == "cache.download" && span.End.Sub(span.Start) >= delay {
+			return
 		}
-		defer os.RemoveAll(prev)
-		defer func() {
-			if err := os.Chdir(wd); err != nil {
-				t.Logf("failed to reset working directory: %v", err)
+	}
+	t.Fatalf("expected a cache.download span that covers reading the archive")
+}
+
+// Counts the reads of output archives.
+type countingTransport struct {
+	cache.TransportReader
+	reads *atomic.Int64
+}
+
+func (t countingTransport) Reader(path string) (io.ReadCloser, error) {
+	rc, err := t.TransportReader.Reader(path)
+	if err != nil || !strings.HasPrefix(path, "outputs/") {
+		return rc, err
+	}
+	return countingReader{ReadCloser: rc, reads: t.reads}, nil
+}
+
+type countingReader struct {
+	io.ReadCloser
+	reads *atomic.Int64
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	r.reads.Add(1)
+	return r.ReadCloser.Read(b)
+}
+
+func TestValidateOnly(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		// Removes the output archive before the node is validated
+		removeArchive bool
+		expected      bool
+	}{
+		{
+			name:     "should hit without downloading the output archive",
+			expected: true,
+		},
+		{
+			name:          "should miss when the output archive is missing",
+			removeArchive: true,
+			expected:      false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if err := os.Chdir(wd); err != nil {
+					t.Logf("failed to reset working directory: %v", err)
+				}
+			}()
+
+			work, err := createTestWorkspace()
+			if err != nil {
+				t.Fatal(err)
 			}
-		}()
+			defer os.RemoveAll(work)
 
-		work, err := createTestWorkspace()
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer os.RemoveAll(work)
+			prev, err := populateTestCache(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.removeArchive {
+				path := filepath.Join(work, ".omni/cache/outputs", prev.GetFingerprint(node)+".tar.zst")
+				if err := os.Remove(path); err != nil {
+					t.Fatalf("failed to remove %q: %v", path, err)
+				}
+			}
 
-		path := filepath.Join(work, "workspace.txt")
-		if err := os.WriteFile(path, []byte("test"), 0o644); err != nil {
-			t.Fatalf("failed to invalidate workspace cache: %v", err)
-		}
+			reads := &atomic.Int64{}
+			cr := cache.NewCacheReader(countingTransport{TransportReader: trans, reads: reads}, configs, []string{"foo", "bar"}, false)
+			defer cr.Cleanup()
+			cr.ValidateOnly()
+			valid, err := validateTestNode(cr, node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid != tc.expected {
+				t.Fatalf("expected valid to be %v, got %v", tc.expected, valid)
+			}
+			if n := reads.Load(); n != 0 {
+				t.Fatalf("expected the output archive not to be read, got %d reads", n)
+			}
+		})
+	}
+}
 
-		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
-		valid, err := cr.Validate(node, deps)
-		if err != nil {
-			t.Fatal(err)
-		}
+func TestValidate(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
 
-		if valid != false {
-			t.Fatalf("expected %v, got %v", false, valid)
-		}
+	commandNode := graph.NewNode("test", "foo", usercfg.PipelineConfig{
+		Command:   "echo changed",
+		DependsOn: node.Pipeline.DependsOn,
+		Includes:  node.Pipeline.Includes,
+		Excludes:  node.Pipeline.Excludes,
+		Outputs:   node.Pipeline.Outputs,
+	})
+	envNode := graph.NewNode("test", "foo", usercfg.PipelineConfig{
+		Env:      []string{"OMNI_TEST_ENV"},
+		Includes: node.Pipeline.Includes,
+		Excludes: node.Pipeline.Excludes,
 	})
 
-	t.Run("should return false when the target cache is invalid", func(t *testing.T) {
-		prev, err := createPrevCacheDir()
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer os.RemoveAll(prev)
-		defer func() {
-			if err := os.Chdir(wd); err != nil {
-				t.Logf("failed to reset working directory: %v", err)
+	testCases := []struct {
+		name string
+		// The node that populates the cache
+		node *graph.Node
+		// Changes the workspace after the cache was populated
+		change func(t *testing.T, work string)
+		// The node that is validated
+		validated *graph.Node
+		expected  bool
+	}{
+		{
+			name:      "should return true when the cache is valid",
+			node:      node,
+			change:    func(t *testing.T, work string) {},
+			validated: node,
+			expected:  true,
+		},
+		{
+			name:      "should return false when a workspace asset changed",
+			node:      node,
+			change:    writeTestFile("workspace.txt"),
+			validated: node,
+		},
+		{
+			name:      "should return false when a target input changed",
+			node:      node,
+			change:    writeTestFile("foo/include.txt"),
+			validated: node,
+		},
+		{
+			name:      "should return false when the cache of a dependency is invalid",
+			node:      node,
+			change:    writeTestFile("bar/include.txt"),
+			validated: node,
+		},
+		{
+			name:      "should return false when a target input was added",
+			node:      node,
+			change:    writeTestFile("foo/added.txt"),
+			validated: node,
+		},
+		{
+			name:      "should return false when a target input was removed",
+			node:      node,
+			change:    removeTestFile("foo/include.txt"),
+			validated: node,
+		},
+		{
+			name: "should return false when a target input was renamed",
+			node: node,
+			change: func(t *testing.T, work string) {
+				src, dst := filepath.Join(work, "foo/include.txt"), filepath.Join(work, "foo/renamed.txt")
+				if err := os.Rename(src, dst); err != nil {
+					t.Fatalf("failed to rename %q: %v", src, err)
+				}
+			},
+			validated: node,
+		},
+		{
+			name:      "should return false when a workspace asset was removed",
+			node:      node,
+			change:    removeTestFile("workspace.txt"),
+			validated: node,
+		},
+		{
+			name:      "should return true when an excluded file was removed",
+			node:      node,
+			change:    removeTestFile("foo/exclude.txt"),
+			validated: node,
+			expected:  true,
+		},
+		{
+			name:      "should return true when only an excluded file changed",
+			node:      node,
+			change:    writeTestFile("foo/exclude.txt"),
+			validated: node,
+			expected:  true,
+		},
+		{
+			name:      "should return false when the command changed",
+			node:      node,
+			change:    func(t *testing.T, work string) {},
+			validated: commandNode,
+		},
+		{
+			name: "should return false when a declared environment variable changed",
+			node: envNode,
+			change: func(t *testing.T, work string) {
+				t.Setenv("OMNI_TEST_ENV", "changed")
+			},
+			validated: envNode,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if err := os.Chdir(wd); err != nil {
+					t.Logf("failed to reset working directory: %v", err)
+				}
+			}()
+
+			work, err := createTestWorkspace()
+			if err != nil {
+				t.Fatal(err)
 			}
-		}()
+			defer os.RemoveAll(work)
 
-		work, err := createTestWorkspace()
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer os.RemoveAll(work)
+			t.Setenv("OMNI_TEST_ENV", "test")
+			if _, err := populateTestCache(tc.node); err != nil {
+				t.Fatal(err)
+			}
+			tc.change(t, work)
 
-		path := filepath.Join(work, "foo/include.txt")
-		if err := os.WriteFile(path, []byte("test"), 0o644); err != nil {
-			t.Fatalf("failed to invalidate target cache: %v", err)
-		}
+			cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
+			defer cr.Cleanup()
+			valid, err := validateTestNode(cr, tc.validated)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
-		valid, err := cr.Validate(node, deps)
-		if err != nil {
-			t.Fatal(err)
-		}
+			if valid != tc.expected {
+				t.Fatalf("expected %v, got %v", tc.expected, valid)
+			}
+		})
+	}
+}
+
+func TestValidateWithDependencyOutputs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		// The output patterns of the dependency, which default to output.txt
+		outputs []string
+		// Changes the workspace after the cache was populated
+		change   func(t *testing.T, work string)
+		expected bool
+	}{
+		{
+			name:     "should return true when a dependency missed but produced the same outputs",
+			change:   writeTestFile("bar/include.txt"),
+			expected: true,
+		},
+		{
+			name:     "should return true when the output patterns of a dependency match directories",
+			outputs:  []string{"dist/**"},
+			change:   writeTestFile("bar/include.txt"),
+			expected: true,
+		},
+		{
+			name:    "should return false when a dependency produced different outputs in a directory",
+			outputs: []string{"dist/**"},
+			change: func(t *testing.T, work string) {
+				writeTestFile("bar/include.txt")(t, work)
+				path := filepath.Join(work, "bar/dist/nested/output.txt")
+				if err := os.WriteFile(path, []byte("different"), 0o644); err != nil {
+					t.Fatalf("failed to write %q: %v", path, err)
+				}
+			},
+		},
+		{
+			name: "should return false when a dependency produced different outputs",
+			change: func(t *testing.T, work string) {
+				writeTestFile("bar/include.txt")(t, work)
+				path := filepath.Join(work, "bar/output.txt")
+				if err := os.WriteFile(path, []byte("different"), 0o644); err != nil {
+					t.Fatalf("failed to write %q: %v", path, err)
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if err := os.Chdir(wd); err != nil {
+					t.Logf("failed to reset working directory: %v", err)
+				}
+			}()
+
+			work, err := createTestWorkspace()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(work)
 
-		if valid != false {
-			t.Fatalf("expected %v, got %v", false, valid)
+			outputs := tc.outputs
+			if outputs == nil {
+				outputs = []string{"output.txt"}
+			}
+			buildNode := graph.NewNode("test", "bar", usercfg.PipelineConfig{
+				Includes: []string{"include.txt"},
+				Outputs:  outputs,
+			})
+
+			// the outputs of the dependency, as if it had been executed
+			writeTestFile("bar/output.txt")(t, work)
+			if err := os.MkdirAll(filepath.Join(work, "bar/dist/nested"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile("bar/dist/nested/output.txt")(t, work)
+
+			cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, true)
+			if _, err := cr.Validate(buildNode, map[string]struct{}{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cr.Validate(node, deps); err != nil {
+				t.Fatal(err)
+			}
+			cw := cache.NewCacheWriter(trans, cr)
+			defer cw.Cleanup()
+			for _, n := range []*graph.Node{buildNode, node} {
+				if err := cw.WriteTaskResult(n.Dir, n.Name, testResult); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := cw.Update(); err != nil {
+				t.Fatal(err)
+			}
+			tc.change(t, work)
+
+			cr = cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
+			defer cr.Cleanup()
+			if valid, err := cr.Validate(buildNode, map[string]struct{}{}); err != nil || valid {
+				t.Fatalf("expected the dependency to miss the cache, got %v: %v", valid, err)
+			}
+			valid, err := cr.Validate(node, deps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid != tc.expected {
+				t.Fatalf("expected %v, got %v", tc.expected, valid)
+			}
+		})
+	}
+}
+
+func TestValidateWithAbsentDependencyOutputs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
+
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Logf("failed to reset working directory: %v", err)
 		}
+	}()
+
+	work, err := createTestWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+
+	buildNode := graph.NewNode("test", "bar", usercfg.PipelineConfig{
+		Includes: []string{"include.txt"},
+		Outputs:  []string{"output.txt"},
 	})
 
-	t.Run("should return false when the cache of a dependency is invalid", func(t *testing.T) {
-		prev, err := createPrevCacheDir()
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer os.RemoveAll(prev)
-		defer func() {
-			if err := os.Chdir(wd); err != nil {
-				t.Logf("failed to reset working directory: %v", err)
-			}
-		}()
+	// the output of the dependency, as if it had been executed
+	writeTestFile("bar/output.txt")(t, work)
 
-		work, err := createTestWorkspace()
-		if err != nil {
+	cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, true)
+	if _, err := cr.Validate(buildNode, map[string]struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.Validate(node, deps); err != nil {
+		t.Fatal(err)
+	}
+	cw := cache.NewCacheWriter(trans, cr)
+	defer cw.Cleanup()
+	for _, n := range []*graph.Node{buildNode, node} {
+		if err := cw.WriteTaskResult(n.Dir, n.Name, testResult); err != nil {
 			t.Fatal(err)
 		}
-		defer os.RemoveAll(work)
+	}
+	if err := cw.Update(); err != nil {
+		t.Fatal(err)
+	}
 
-		path := filepath.Join(work, "bar/include.txt")
-		if err := os.WriteFile(path, []byte("test"), 0o644); err != nil {
-			t.Fatalf("failed to invalidate target cache: %v", err)
+	// like a fresh checkout, where the outputs of the dependency haven't been restored
+	if err := os.Remove(filepath.Join(work, "bar/output.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should predict a hit when the dependency hit", func(t *testing.T) {
+		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
+		cr.ValidateOnly()
+		if valid, err := cr.Validate(buildNode, map[string]struct{}{}); err != nil || !valid {
+			t.Fatalf("expected the dependency to hit the cache, got %v: %v", valid, err)
 		}
+		if valid, err := cr.Validate(node, deps); err != nil || !valid {
+			t.Fatalf("expected a cache hit, got %v: %v", valid, err)
+		}
+	})
 
+	t.Run("should explain a hit when the dependency hit", func(t *testing.T) {
 		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
-		depNode := graph.NewNode("test", "bar", configs["bar"].Pipeline["test"])
-		if _, err := cr.Validate(depNode, map[string]struct{}{}); err != nil {
+		cr.ValidateOnly()
+		if _, err := cr.Validate(buildNode, map[string]struct{}{}); err != nil {
 			t.Fatal(err)
 		}
-
-		valid, err := cr.Validate(node, deps)
+		expl, err := cr.Explain(node, deps)
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		if valid != false {
-			t.Fatalf("expected %v, got %v", false, valid)
+		if !expl.Valid || len(expl.DependenciesChanged) > 0 {
+			t.Fatalf("expected a hit without changed dependencies, got %+v", expl)
 		}
 	})
+}
 
-	t.Run("should return true when only an excluded file is invalid", func(t *testing.T) {
-		prev, err := createPrevCacheDir()
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer os.RemoveAll(prev)
-		defer func() {
-			if err := os.Chdir(wd); err != nil {
-				t.Logf("failed to reset working directory: %v", err)
+func TestValidateLogs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		// Whether the cache is populated before the node is validated
+		populate bool
+		noCache  bool
+		// Changes the cache after it was populated
+		change   func(t *testing.T, work, fingerprint string)
+		expected []string
+	}{
+		{
+			name:     "should explain a miss without a cache entry",
+			expected: []string{`level=DEBUG msg="cache miss" task=foo:test reason="no cache entry for fingerprint"`},
+		},
+		{
+			name:     "should explain a miss when cache reads are disabled",
+			populate: true,
+			noCache:  true,
+			expected: []string{`level=DEBUG msg="cache miss" task=foo:test reason="cache reads are disabled"`},
+		},
+		{
+			name:     "should warn about a cache entry without its output archive",
+			populate: true,
+			change: func(t *testing.T, work, fingerprint string) {
+				path := filepath.Join(work, ".omni/cache/outputs", fingerprint+".tar.zst")
+				if err := os.Remove(path); err != nil {
+					t.Fatalf("failed to remove %q: %v", path, err)
+				}
+			},
+			expected: []string{
+				`level=WARN msg="cache entry has no output archive" task=foo:test`,
+				`level=DEBUG msg="cache miss" task=foo:test reason="output archive missing"`,
+			},
+		},
+		{
+			name:     "should log the fingerprint of a hit",
+			populate: true,
+			expected: []string{`level=DEBUG msg="cache hit" task=foo:test fingerprint=`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if err := os.Chdir(wd); err != nil {
+					t.Logf("failed to reset working directory: %v", err)
+				}
+			}()
+
+			work, err := createTestWorkspace()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(work)
+
+			if tc.populate {
+				cr, err := populateTestCache(node)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.change != nil {
+					tc.change(t, work, cr.GetFingerprint(node))
+				}
 			}
-		}()
 
-		work, err := createTestWorkspace()
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer os.RemoveAll(work)
+			if err := log.SetLevel("debug"); err != nil {
+				t.Fatal(err)
+			}
+			defer log.SetLevel("")
+
+			cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, tc.noCache)
+			defer cr.Cleanup()
+			res := captureStderr(t, func() {
+				if _, err := validateTestNode(cr, node); err != nil {
+					t.Error(err)
+				}
+			})
+
+			for _, expected := range tc.expected {
+				if findLogLine(res, expected) == "" {
+					t.Fatalf("expected a line containing %q, got %q", expected, res)
+				}
+			}
+		})
+	}
+}
+
+func TestGetFingerprint(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
 
-		path := filepath.Join(work, "foo/exclude.txt")
-		if err := os.WriteFile(path, []byte("test"), 0o644); err != nil {
-			t.Fatalf("failed to invalidate target cache: %v", err)
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Logf("failed to reset working directory: %v", err)
 		}
+	}()
 
-		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
-		valid, err := cr.Validate(node, deps)
-		if err != nil {
+	work, err := createTestWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+
+	fingerprint := func() string {
+		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, true)
+		if _, err := validateTestNode(cr, node); err != nil {
 			t.Fatal(err)
 		}
+		return cr.GetFingerprint(node)
+	}
 
-		if valid != true {
-			t.Fatalf("expected %v, got %v", true, valid)
-		}
-	})
+	first := fingerprint()
+	if first == "" {
+		t.Fatal("expected a fingerprint, got an empty string")
+	}
+	if second := fingerprint(); first != second {
+		t.Fatalf("expected %q, got %q", first, second)
+	}
+
+	writeTestFile("foo/include.txt")(t, work)
+	changed := fingerprint()
+	if first == changed {
+		t.Fatalf("expected the fingerprint to change, got %q", changed)
+	}
+
+	writeTestFile("bar/include.txt")(t, work)
+	if depChanged := fingerprint(); changed == depChanged {
+		t.Fatalf("expected the fingerprint to change with its dependency, got %q", depChanged)
+	}
 }
 
-func createPrevCacheDir() (string, error) {
-	tmp := filepath.Join(os.TempDir(), "omni-prev-cache")
-	if err := os.RemoveAll(tmp); err != nil {
-		return "", err
+func TestExplain(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
 	}
 
-	if err := os.MkdirAll(tmp, 0o755); err != nil {
-		return "", err
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Logf("failed to reset working directory: %v", err)
+		}
+	}()
+
+	work, err := createTestWorkspace()
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(work)
 
-	return tmp, nil
-}
+	if _, err := populateTestCache(node); err != nil {
+		t.Fatal(err)
+	}
 
-func createTestTaskResult(tmp, dir, name string, res cache.TaskResult) error {
-	path := filepath.Join(tmp, dir, "results", name+".json")
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return fmt.Errorf("failed to create test directories: %v", err)
+	writeTestFile("foo/include.txt")(t, work)
+	writeTestFile("foo/added.txt")(t, work)
+	if err := os.Remove(filepath.Join(work, "foo/output.txt")); err != nil {
+		t.Fatalf("failed to remove input: %v", err)
 	}
 
-	b, err := json.Marshal(res)
+	cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
+	defer cr.Cleanup()
+	if _, err := cr.Validate(depNode, map[string]struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	expl, err := cr.Explain(node, deps)
 	if err != nil {
-		return fmt.Errorf("failed to marshal test task result: %v", err)
+		t.Fatal(err)
 	}
 
-	if err := os.WriteFile(path, b, 0o644); err != nil {
-		return fmt.Errorf("failed to write test file: %v", err)
+	exp := cache.Explanation{
+		Id:                  "foo:test",
+		InvalidDependencies: []string{},
+		EnvChanged:          []string{},
+		DependenciesChanged: []string{},
+		Added:               []string{"foo/added.txt"},
+		Removed:             []string{"foo/output.txt"},
+		Changed:             []string{"foo/include.txt"},
 	}
+	if !reflect.DeepEqual(exp, expl) {
+		t.Fatalf("expected %+v, got %+v", exp, expl)
+	}
+}
 
-	return nil
+// Returns a change that overwrites a file in the workspace, or creates it if it doesn't exist.
+func writeTestFile(path string) func(t *testing.T, work string) {
+	return func(t *testing.T, work string) {
+		if err := os.WriteFile(filepath.Join(work, path), []byte("changed"), 0o644); err != nil {
+			t.Fatalf("failed to write %q: %v", path, err)
+		}
+	}
+}
+
+// Returns a change that removes a file from the workspace.
+func removeTestFile(path string) func(t *testing.T, work string) {
+	return func(t *testing.T, work string) {
+		if err := os.Remove(filepath.Join(work, path)); err != nil {
+			t.Fatalf("failed to remove %q: %v", path, err)
+		}
+	}
 }
@@ -1,13 +1,19 @@
 package cache
 
+import "time"
+
 type TaskResult struct {
-	Logs   string
-	Failed bool
+	Logs     string
+	Failed   bool
+	ExitCode int
+	Duration time.Duration
 }
 
-func NewTaskResult(logs string, failed bool) TaskResult {
+func NewTaskResult(logs string, exitCode int, duration time.Duration) TaskResult {
 	return TaskResult{
-		Logs:   logs,
-		Failed: failed,
+		Logs:     logs,
+		Failed:   exitCode != 0,
+		ExitCode: exitCode,
+		Duration: duration,
 	}
 }
@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A temporary directory that belongs to a single invocation, so that concurrent runs never share files.
+// The directory is created when it's first needed.
+type tmpDir struct {
+	pattern string
+	once    sync.Once
+	path    string
+	err     error
+}
+
+func newTmpDir(pattern string) *tmpDir {
+	return &tmpDir{pattern: pattern}
+}
+
+func (d *tmpDir) get() (string, error) {
+	d.once.Do(func() {
+		d.path, d.err = os.MkdirTemp("", d.pattern)
+		if d.err != nil {
+			d.err = fmt.Errorf("failed to create cache directory: %v", d.err)
+		}
+	})
+	return d.path, d.err
+}
+
+// Removes the directory if it was created. The directory can't be created after it's removed.
+func (d *tmpDir) remove() error {
+	d.once.Do(func() {
+		d.err = fmt.Errorf("failed to create cache directory: it has already been removed")
+	})
+	if d.path == "" {
+		return nil
+	}
+	if err := os.RemoveAll(d.path); err != nil {
+		return fmt.Errorf("failed to remove cache directory %q: %v", d.path, err)
+	}
+	return nil
+}
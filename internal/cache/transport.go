@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"io"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/log"
+)
+
+// Logs the duration of every read from the underlying transport.
+type timedTransportReader struct {
+	transport TransportReader
+}
+
+func (t timedTransportReader) Reader(path string) (io.ReadCloser, error) {
+	start := time.Now()
+	r, err := t.transport.Reader(path)
+	log.Debug("transport read", "path", path, "duration", time.Since(start), "error", err)
+	return r, err
+}
+
+// Logs the duration of every write to the underlying transport, from opening the writer until it's closed.
+// Remote transports upload when the writer is closed, so this includes the upload.
+type timedTransportWriter struct {
+	transport TransportWriter
+}
+
+func (t timedTransportWriter) Writer(path string) (io.WriteCloser, error) {
+	start := time.Now()
+	w, err := t.transport.Writer(path)
+	if err != nil {
+		log.Debug("transport write", "path", path, "duration", time.Since(start), "error", err)
+		return nil, err
+	}
+
+	return &timedWriteCloser{WriteCloser: w, path: path, start: start}, nil
+}
+
+type timedWriteCloser struct {
+	io.WriteCloser
+	path  string
+	start time.Time
+}
+
+func (w *timedWriteCloser) Close() error {
+	err := w.WriteCloser.Close()
+	log.Debug("transport write", "path", w.path, "duration", time.Since(w.start), "error", err)
+	return err
+}
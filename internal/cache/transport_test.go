@@ -0,0 +1,103 @@
+package cache_test
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+	"github.com/mitchelldw01/omnirepo/internal/log"
+)
+
+func TestTransportLogs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
+
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Logf("failed to reset working directory: %v", err)
+		}
+	}()
+
+	work, err := createTestWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+
+	if err := log.SetLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer log.SetLevel("")
+
+	var cr *cache.CacheReader
+	res := captureStderr(t, func() {
+		cr, err = populateTestCache(node)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := cr.GetFingerprint(node)
+
+	t.Run("should log the duration of every write", func(t *testing.T) {
+		line := findLogLine(res, `msg="transport write" path=tasks/`+fingerprint+".json")
+		if line == "" {
+			t.Fatalf("expected a transport write line, got %q", res)
+		}
+		if !strings.Contains(line, "duration=") {
+			t.Fatalf("expected the line to contain the duration, got %q", line)
+		}
+	})
+
+	t.Run("should log the duration of every read", func(t *testing.T) {
+		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
+		defer cr.Cleanup()
+		res := captureStderr(t, func() {
+			validateTestNode(cr, node)
+		})
+
+		line := findLogLine(res, `msg="transport read" path=tasks/`+fingerprint+".json")
+		if line == "" {
+			t.Fatalf("expected a transport read line, got %q", res)
+		}
+		if !strings.Contains(line, "duration=") || !strings.Contains(line, "error=<nil>") {
+			t.Fatalf("expected the line to contain the duration and no error, got %q", line)
+		}
+	})
+}
+
+// Returns the first line of the logs that contains the substring, or an empty string.
+func findLogLine(logs, substr string) string {
+	for _, line := range strings.Split(logs, "\n") {
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+	return ""
+}
+
+func captureStderr(t *testing.T, f func()) string {
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = w
+	defer func() {
+		os.Stderr = stderr
+	}()
+
+	// The pipe is read concurrently, so that writes don't block when its buffer is full
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+
+	f()
+	w.Close()
+	return <-done
+}
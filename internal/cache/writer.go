@@ -4,16 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/fs"
-	"os"
+	"maps"
 	"path/filepath"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/briandowns/spinner"
 	"github.com/mitchelldw01/omnirepo/internal/log"
-	"github.com/mitchelldw01/omnirepo/usercfg"
+	"github.com/mitchelldw01/omnirepo/internal/trace"
 )
 
 // Provides an io.WriteCloser that writes to the final cache destination.
@@ -26,42 +23,72 @@ type CacheWriter struct {
 	transport TransportWriter
 	reader    *CacheReader
 	// The temporary directory for cache files before they're compressed
-	tmpCache string
+	tmpCache *tmpDir
+	// Map from node IDs to the durations of tasks executed in this run
+	durations *concurrentMap[time.Duration]
+	// Map from node IDs to the cache entries of tasks executed in this run
+	entries *concurrentMap[taskEntry]
 }
 
 func NewCacheWriter(tw TransportWriter, cr *CacheReader) *CacheWriter {
 	return &CacheWriter{
-		transport: tw,
+		transport: timedTransportWriter{tw},
 		reader:    cr,
-		tmpCache:  filepath.Join(os.TempDir(), "omni-next-cache"),
+		tmpCache:  newTmpDir("omni-next-cache-"),
+		durations: newConcurrentMap[time.Duration](),
+		entries:   newConcurrentMap[taskEntry](),
 	}
 }
 
+// Removes the outputs that were copied for the cache, once the cache has been updated.
+func (w *CacheWriter) Cleanup() error {
+	return w.tmpCache.remove()
+}
+
+// The result is stored by the fingerprint of the node, which must have been validated.
 func (w *CacheWriter) WriteTaskResult(dir, name string, res TaskResult) error {
-	path := filepath.Join(w.tmpCache, dir, "results", name+".json")
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return fmt.Errorf("failed to write task result: %v", err)
+	id := fmt.Sprintf("%s:%s", dir, name)
+	key, ok := w.reader.keys.get(id)
+	if !ok {
+		return fmt.Errorf("failed to write task result: %q has not been validated", id)
 	}
 
-	b, err := json.Marshal(res)
+	// The outputs are copied right away, so that later tasks can't change them before they're archived
+	tmp, err := w.tmpCache.get()
 	if err != nil {
-		return fmt.Errorf("failed to marshal task result: %v", err)
+		return err
 	}
-
-	if err := os.WriteFile(path, b, 0o644); err != nil {
-		return fmt.Errorf("failed to write cache result: %v", err)
+	fingerprint, _ := w.reader.fingerprints.get(id)
+	if err := copyOutputs(dir, key.Outputs, filepath.Join(tmp, fingerprint)); err != nil {
+		return fmt.Errorf("failed to write outputs of %q: %v", id, err)
 	}
 
+	entry := taskEntry{taskKey: key, Result: res}
+	if len(key.Outputs) > 0 {
+		if entry.OutputsHash, err = w.reader.hashDependency(id); err != nil {
+			return fmt.Errorf("failed to write outputs of %q: %v", id, err)
+		}
+	}
+	w.entries.put(id, entry)
+	w.durations.put(id, res.Duration)
 	return nil
 }
 
 func (w *CacheWriter) Update() error {
-	if err := w.restoreOutputs(); err != nil {
-		return fmt.Errorf("failed to restore cached outputs: %v", err)
-	}
+	span := trace.Start("cache.update")
+	defer span.End()
 
+	// When every task hit the cache, only the durations of tasks that had none yet are recorded
 	if w.reader.invalidNodes.size() == 0 {
-		return nil
+		return w.updateDurations(span)
+	}
+
+	if log.Format == log.Json {
+		start := time.Now()
+		log.CacheUploadStarted()
+		err := w.upload(span)
+		log.CacheUploadFinished(time.Since(start), err)
+		return err
 	}
 
 	s, err := w.startSpinner()
@@ -69,17 +96,15 @@ func (w *CacheWriter) Update() error {
 		defer s.Stop()
 	}
 
-	if err := w.updateWorkspace(); err != nil {
-		return err
-	}
+	return w.upload(span)
+}
 
-	for dir, connMap := range w.reader.invalidNodes.toUnsafeMap() {
-		if err := w.updateTarget(dir, connMap); err != nil {
-			return err
-		}
+func (w *CacheWriter) upload(span *trace.Span) error {
+	if err := w.updateEntries(span); err != nil {
+		return err
 	}
 
-	return nil
+	return w.updateDurations(span)
 }
 
 func (w *CacheWriter) startSpinner() (*spinner.Spinner, error) {
@@ -99,256 +124,100 @@ func (w *CacheWriter) startSpinner() (*spinner.Spinner, error) {
 	return s, nil
 }
 
-func (w *CacheWriter) updateWorkspace() error {
-	paths, err := w.getWorkspacePaths()
+// Uploads the cache entry of every task executed in this run, and records the fingerprints
+// of every task with a cache entry so that later runs can explain their cache misses.
+func (w *CacheWriter) updateEntries(span *trace.Span) error {
+	last, err := w.reader.getLastFingerprints()
 	if err != nil {
 		return err
 	}
+	fingerprints := maps.Clone(last.data)
 
-	hashes, err := w.computeHashMap(paths)
-	if err != nil {
-		return err
+	for id := range w.reader.entries.data {
+		fingerprints[id], _ = w.reader.fingerprints.get(id)
 	}
 
-	return w.writeWorkspaceArtifacts(hashes)
-}
-
-func (w *CacheWriter) getWorkspacePaths() ([]string, error) {
-	patternSet := map[string]struct{}{}
-	for dir := range w.reader.invalidNodes.toUnsafeMap() {
-		for _, pattern := range w.reader.targetConfigs[dir].WorkspaceAssets {
-			patternSet[pattern] = struct{}{}
+	for id, entry := range w.entries.data {
+		fingerprint, _ := w.reader.fingerprints.get(id)
+		// The archive is written first, so that an entry never exists without its outputs
+		if len(entry.Outputs) > 0 {
+			if err := w.writeOutputArchive(span, fingerprint); err != nil {
+				return err
+			}
 		}
+		if err := w.writeArtifact(span, entryPath(fingerprint), entry); err != nil {
+			return err
+		}
+		fingerprints[id] = fingerprint
 	}
 
-	patterns := []string{}
-	for pattern := range patternSet {
-		patterns = append(patterns, pattern)
-	}
-
-	return getCacheableWorkspacePaths(patterns, w.reader.targets)
-}
-
-func (w *CacheWriter) computeHashMap(paths []string) (map[string]struct{}, error) {
-	hashes, err := w.reader.hasher.hash(paths...)
-	if err != nil {
-		return nil, err
-	}
-
-	hashMap := make(map[string]struct{}, len(hashes))
-	for _, hash := range hashes {
-		hashMap[hash] = struct{}{}
-	}
-
-	return hashMap, nil
+	return w.writeArtifact(span, "fingerprints.json", fingerprints)
 }
 
-func (w *CacheWriter) writeWorkspaceArtifacts(hashes map[string]struct{}) error {
-	b, err := json.Marshal(hashes)
-	if err != nil {
-		return fmt.Errorf("failed to marshal workspace hashes: %v", err)
-	}
-
-	tw, err := w.transport.Writer("workspace.json")
+// Marshals the value as JSON and uploads it to the path in the cache.
+func (w *CacheWriter) writeArtifact(span *trace.Span, path string, v any) error {
+	b, err := json.Marshal(v)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to marshal cache artifact %q: %v", path, err)
 	}
-	defer tw.Close()
 
-	_, err = tw.Write(b)
-	return err
-}
+	uploadSpan := span.Start("cache.upload")
+	uploadSpan.SetAttribute("path", path)
+	defer uploadSpan.End()
 
-func (w *CacheWriter) updateTarget(dir string, hashes map[string]struct{}) error {
-	includes := w.concatIncludesPatterns(w.reader.targetConfigs[dir], hashes)
-	excludes := w.concatExcludesPatterns(w.reader.targetConfigs[dir], hashes)
-	paths, err := getCacheableTargetPaths(dir, includes, excludes)
+	tw, err := w.transport.Writer(path)
 	if err != nil {
 		return err
 	}
-
-	hashMap, err := w.computeHashMap(paths)
-	if err != nil {
+	if _, err := tw.Write(b); err != nil {
+		tw.Close()
 		return err
 	}
 
-	return w.writeTargetArtifacts(dir, hashMap)
+	return tw.Close()
 }
 
-func (w *CacheWriter) concatIncludesPatterns(cfg usercfg.TargetConfig, hashes map[string]struct{}) []string {
-	patternSet := map[string]struct{}{}
-
-	for task := range hashes {
-		for _, pattern := range cfg.Pipeline[task].Includes {
-			patternSet[pattern] = struct{}{}
+// Merges the durations of tasks executed in this run with the durations from previous runs.
+// Tasks that hit the cache without a previous duration get the duration from their cache entry,
+// so that every task has a duration to be scheduled by. Nothing is written when no durations changed.
+func (w *CacheWriter) updateDurations(span *trace.Span) error {
+	durations := maps.Clone(w.reader.durations.data)
+	for id, entry := range w.reader.entries.data {
+		if _, ok := durations[id]; !ok && entry.Result.Duration > 0 {
+			durations[id] = entry.Result.Duration
 		}
 	}
+	maps.Copy(durations, w.durations.data)
 
-	patterns := []string{}
-	for pattern := range patternSet {
-		patterns = append(patterns, pattern)
-	}
-
-	return patterns
-}
-
-func (w *CacheWriter) concatExcludesPatterns(cfg usercfg.TargetConfig, hashes map[string]struct{}) []string {
-	patternSet := map[string]struct{}{}
-
-	for task := range hashes {
-		for _, pattern := range cfg.Pipeline[task].Excludes {
-			patternSet[pattern] = struct{}{}
-		}
-	}
-
-	patterns := []string{}
-	for pattern := range patternSet {
-		patterns = append(patterns, pattern)
+	if maps.Equal(durations, w.reader.durations.data) {
+		return nil
 	}
-
-	return patterns
+	return w.writeArtifact(span, "durations.json", durations)
 }
 
-func (w *CacheWriter) writeTargetArtifacts(dir string, hashes map[string]struct{}) error {
-	tmp := filepath.Join(w.tmpCache, dir)
-	if err := os.MkdirAll(tmp, 0o755); err != nil {
-		return fmt.Errorf("failed to write cache artifact: %v", err)
-	}
-	if err := w.writeInputArtifacts(tmp, hashes); err != nil {
-		return err
-	}
-	if err := w.writeOutputArtifacts(dir, w.reader.outputs.data[dir]); err != nil {
-		return err
-	}
-
-	tw, err := w.transport.Writer(fmt.Sprintf("%s-meta.tar.zst", dir))
+func (w *CacheWriter) writeOutputArchive(span *trace.Span, fingerprint string) error {
+	tmp, err := w.tmpCache.get()
 	if err != nil {
 		return err
 	}
-	defer tw.Close()
-
-	return createTarZst(tmp, tw)
-}
-
-func (w *CacheWriter) writeInputArtifacts(dir string, hashes map[string]struct{}) error {
-	inputsJson, err := json.Marshal(hashes)
-	if err != nil {
-		return fmt.Errorf("failed to marshal target hashes %q: %v", dir, hashes)
-	}
-
-	path := filepath.Join(dir, "inputs.json")
-	if err := os.WriteFile(path, inputsJson, 0o644); err != nil {
-		return fmt.Errorf("failed to write cache artifact: %v", err)
-	}
-
-	return nil
-}
-
-func (w *CacheWriter) writeOutputArtifacts(dir string, patterns []string) error {
-	paths, err := getCacheableOutputPaths(dir, patterns)
+	path := outputArchivePath(fingerprint)
+	tw, err := w.transport.Writer(path)
 	if err != nil {
 		return err
 	}
 
-	for _, path := range paths {
-		dst := filepath.Join(w.tmpCache, dir, "outputs", w.trimTargetDirectory(path))
-		if err := w.copyOutputArtifact(path, dst); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (w *CacheWriter) trimTargetDirectory(path string) string {
-	cleaned := filepath.Clean(path)
-	trimmed := strings.TrimPrefix(cleaned, string(filepath.Separator))
-	parts := strings.Split(trimmed, string(filepath.Separator))
-	return filepath.Join(parts[1:]...)
-}
-
-func (w *CacheWriter) restoreOutputs() error {
-	var wg sync.WaitGroup
-	ch := make(chan error, 1)
-
-	for dir, outputs := range w.reader.outputs.data {
-		wg.Add(1)
-		go func(dir string, outputs []string) {
-			defer wg.Done()
-			if err := w.restoreTargetOutputs(dir); err != nil {
-				select {
-				case ch <- err:
-				default:
-				}
-			}
-		}(dir, outputs)
-	}
-
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-
-	return <-ch
-}
-
-func (w *CacheWriter) restoreTargetOutputs(dir string) error {
-	src := filepath.Join(w.reader.tmpCache, dir, "outputs")
-	if _, err := os.Stat(src); os.IsNotExist(err) {
-		return nil
-	}
-
-	return w.copyOutputDirectory(src, dir)
-}
-
-func (w *CacheWriter) copyOutputDirectory(src, dst string) error {
-	if err := os.MkdirAll(dst, 0o755); err != nil {
-		return fmt.Errorf("failed to create cache directory %q: %v", dst, err)
-	}
-
-	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return fmt.Errorf("failed to walk directory %q: %v", src, err)
-		}
-
-		rel, err := filepath.Rel(src, path)
-		if err != nil {
-			return fmt.Errorf("failed to determine relative file path from %q to %q: %v", src, path, err)
-		}
-		dstPath := filepath.Join(dst, rel)
-
-		if info.IsDir() {
-			if err := os.MkdirAll(dstPath, 0o755); err != nil {
-				return fmt.Errorf("failed to create cache directory %q: %v", dstPath, err)
-			}
-			return nil
-		}
-
-		return w.copyOutputArtifact(path, dstPath)
-	})
-}
-
-func (w *CacheWriter) copyOutputArtifact(src, dst string) error {
-	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
-		return fmt.Errorf("failed to create cache directory %q: %v", dst, err)
-	}
-
-	srcFile, err := os.Open(src)
+	archiveSpan := span.Start("cache.archive")
+	archiveSpan.SetAttribute("path", path)
+	err = createTarZst(filepath.Join(tmp, fingerprint), tw)
+	archiveSpan.End()
 	if err != nil {
-		return fmt.Errorf("failed to open file %q: %v", src, err)
-	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return fmt.Errorf("failed to create cache artifact %q: %v", dst, err)
-	}
-	defer dstFile.Close()
-
-	_, err = io.Copy(dstFile, srcFile)
-	if err != nil {
-		return fmt.Errorf("failed to copy %q to %q: %v", src, dst, err)
+		tw.Close()
+		return err
 	}
 
-	return nil
+	// Remote transports upload the archive when the writer is closed
+	uploadSpan := span.Start("cache.upload")
+	uploadSpan.SetAttribute("path", path)
+	defer uploadSpan.End()
+	return tw.Close()
 }
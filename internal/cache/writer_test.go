@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/mitchelldw01/omnirepo/internal/cache"
@@ -40,35 +41,59 @@ var (
 			},
 		},
 	}
-	deps  = map[string]struct{}{"bar:test": {}}
-	node  = graph.NewNode("test", "foo", configs["foo"].Pipeline["test"])
-	trans = sys.NewSystemTransport()
+	deps       = map[string]struct{}{"bar:test": {}}
+	node       = graph.NewNode("test", "foo", configs["foo"].Pipeline["test"])
+	depNode    = graph.NewNode("test", "bar", configs["bar"].Pipeline["test"])
+	testResult = cache.NewTaskResult("logs", 0, time.Second)
+	trans      = sys.NewSystemTransport()
 )
 
 func TestWriteTaskResult(t *testing.T) {
-	trans := sys.NewSystemTransport()
-	cr := cache.NewCacheReader(trans, nil, nil, false)
-	cw := cache.NewCacheWriter(trans, cr)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
+	defer func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Logf("failed to reset working directory: %v", err)
+		}
+	}()
 
-	dir, name := "dir", "name"
-	exp := cache.NewTaskResult("logs", false)
-	if err := cw.WriteTaskResult(dir, name, exp); err != nil {
+	work, err := createTestWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+
+	cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, true)
+	if _, err := cr.Validate(depNode, map[string]struct{}{}); err != nil {
 		t.Fatal(err)
 	}
 
-	path := filepath.Join(os.TempDir(), "omni-next-cache", dir, "results", name+".json")
+	cw := cache.NewCacheWriter(trans, cr)
+	defer cw.Cleanup()
+	if err := cw.WriteTaskResult("bar", "test", testResult); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(work, ".omni/cache/tasks", cr.GetFingerprint(depNode)+".json")
 	b, err := os.ReadFile(path)
 	if err != nil {
-		t.Fatalf("failed to read task result: %v", err)
+		t.Fatalf("failed to read cache entry: %v", err)
 	}
 
-	var res cache.TaskResult
-	if err := json.Unmarshal(b, &res); err != nil {
-		t.Fatalf("failed to marshal task result: %v", err)
+	var entry struct {
+		Result cache.TaskResult `json:"result"`
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		t.Fatalf("failed to unmarshal cache entry: %v", err)
 	}
 
-	if !reflect.DeepEqual(exp, res) {
-		t.Fatalf("expected %v, got %v", exp, res)
+	if !reflect.DeepEqual(testResult, entry.Result) {
+		t.Fatalf("expected %v, got %v", testResult, entry.Result)
 	}
 }
 
@@ -78,11 +103,6 @@ func TestUpdate(t *testing.T) {
 		t.Fatalf("failed to get current directory: %v", err)
 	}
 
-	prev, err := createPrevCacheDir()
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(prev)
 	defer func() {
 		if err := os.Chdir(wd); err != nil {
 			t.Logf("failed to reset working directory: %v", err)
@@ -95,32 +115,40 @@ func TestUpdate(t *testing.T) {
 	}
 	defer os.RemoveAll(work)
 
-	cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
-	if _, err := cr.Validate(node, deps); err != nil {
+	cr, err := populateTestCache(node)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	// remove task output to test that it gets restored
-	output := filepath.Join(work, "foo/output.txt")
-	if err := os.Remove(output); err != nil {
-		t.Fatalf("failed to remove %q: %v", output, err)
-	}
+	t.Run("should create a cache entry for every task", func(t *testing.T) {
+		for _, n := range []*graph.Node{node, depNode} {
+			path := filepath.Join(work, ".omni/cache/tasks", cr.GetFingerprint(n)+".json")
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				t.Fatalf("expected %q to exist", path)
+			}
+		}
+	})
 
-	cw := cache.NewCacheWriter(trans, cr)
-	if err := cw.Update(); err != nil {
-		t.Fatal(err)
-	}
+	t.Run("should record the fingerprint of every task", func(t *testing.T) {
+		b, err := os.ReadFile(filepath.Join(work, ".omni/cache/fingerprints.json"))
+		if err != nil {
+			t.Fatalf("failed to read fingerprints: %v", err)
+		}
+
+		var fingerprints map[string]string
+		if err := json.Unmarshal(b, &fingerprints); err != nil {
+			t.Fatalf("failed to unmarshal fingerprints: %v", err)
+		}
 
-	t.Run("should create the workspace.json", func(t *testing.T) {
-		path := filepath.Join(work, ".omni/cache/workspace.json")
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			t.Fatalf("expected %q to exist", path)
+		exp := map[string]string{node.Id: cr.GetFingerprint(node), depNode.Id: cr.GetFingerprint(depNode)}
+		if !reflect.DeepEqual(exp, fingerprints) {
+			t.Fatalf("expected %v, got %v", exp, fingerprints)
 		}
 	})
 
-	t.Run("should create the foo-meta.tar.zst with the correct contents", func(t *testing.T) {
-		path := filepath.Join(work, ".omni/cache/foo-meta.tar.zst")
-		headers := []string{"inputs.json", "outputs/output.txt", "results/test.json"}
+	t.Run("should archive the outputs of tasks with outputs", func(t *testing.T) {
+		path := filepath.Join(work, ".omni/cache/outputs", cr.GetFingerprint(node)+".tar.zst")
+		headers := []string{"output.txt"}
 		ok, err := checkTarZstContents(path, headers)
 		if err != nil {
 			t.Fatalf("failed to verify tar contents: %v", err)
@@ -128,27 +156,107 @@ func TestUpdate(t *testing.T) {
 		if !ok {
 			t.Fatal(err)
 		}
+
+		path = filepath.Join(work, ".omni/cache/outputs", cr.GetFingerprint(depNode)+".tar.zst")
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %q not to exist", path)
+		}
 	})
 
-	t.Run("should create the bar-meta.tar.zst with the correct contents", func(t *testing.T) {
-		path := filepath.Join(work, ".omni/cache/bar-meta.tar.zst")
-		headers := []string{"inputs.json", "results/test.json"}
-		ok, err := checkTarZstContents(path, headers)
-		if err != nil {
-			t.Fatalf("failed to verify tar contents: %v", err)
+	t.Run("should record durations from the cache entries when every task hits the cache", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(work, ".omni/cache/durations.json")); err != nil {
+			t.Fatal(err)
 		}
-		if !ok {
+
+		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
+		defer cr.Cleanup()
+		if _, err := cr.GetDurations(); err != nil {
+			t.Fatal(err)
+		}
+		if valid, err := validateTestNode(cr, node); err != nil || !valid {
+			t.Fatalf("expected a cache hit, got %v: %v", valid, err)
+		}
+
+		cw := cache.NewCacheWriter(trans, cr)
+		defer cw.Cleanup()
+		if err := cw.Update(); err != nil {
 			t.Fatal(err)
 		}
+
+		b, err := os.ReadFile(filepath.Join(work, ".omni/cache/durations.json"))
+		if err != nil {
+			t.Fatalf("failed to read durations: %v", err)
+		}
+		var durations map[string]time.Duration
+		if err := json.Unmarshal(b, &durations); err != nil {
+			t.Fatalf("failed to unmarshal durations: %v", err)
+		}
+
+		exp := map[string]time.Duration{node.Id: time.Second, depNode.Id: time.Second}
+		if !reflect.DeepEqual(exp, durations) {
+			t.Fatalf("expected %v, got %v", exp, durations)
+		}
 	})
 
-	t.Run("should restore cached outputs", func(t *testing.T) {
-		if _, err := os.Stat(output); os.IsNotExist(err) {
-			t.Fatalf("expected %q to exist", output)
+	t.Run("should not overwrite the outputs of cache misses", func(t *testing.T) {
+		writeTestFile("foo/include.txt")(t, work)
+
+		cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, false)
+		defer cr.Cleanup()
+		if valid, err := validateTestNode(cr, node); err != nil || valid {
+			t.Fatalf("expected a cache miss, got %v: %v", valid, err)
+		}
+
+		output := filepath.Join(work, "foo/output.txt")
+		if err := os.WriteFile(output, []byte("fresh"), 0o644); err != nil {
+			t.Fatalf("failed to write %q: %v", output, err)
+		}
+
+		cw := cache.NewCacheWriter(trans, cr)
+		defer cw.Cleanup()
+		if err := cw.WriteTaskResult(node.Dir, node.Name, testResult); err != nil {
+			t.Fatal(err)
+		}
+		if err := cw.Update(); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", output, err)
+		}
+		if string(b) != "fresh" {
+			t.Fatalf("expected %q, got %q", "fresh", string(b))
 		}
 	})
 }
 
+// Executes the node and its dependency once, so that the cache contains an entry for each of them.
+func populateTestCache(n *graph.Node) (*cache.CacheReader, error) {
+	cr := cache.NewCacheReader(trans, configs, []string{"foo", "bar"}, true)
+	if _, err := validateTestNode(cr, n); err != nil {
+		return nil, err
+	}
+
+	cw := cache.NewCacheWriter(trans, cr)
+	defer cw.Cleanup()
+	for _, n := range []*graph.Node{depNode, n} {
+		if err := cw.WriteTaskResult(n.Dir, n.Name, testResult); err != nil {
+			return nil, err
+		}
+	}
+
+	return cr, cw.Update()
+}
+
+// Validates the dependency of the node first, like the executor does.
+func validateTestNode(cr *cache.CacheReader, n *graph.Node) (bool, error) {
+	if _, err := cr.Validate(depNode, map[string]struct{}{}); err != nil {
+		return false, err
+	}
+	return cr.Validate(n, deps)
+}
+
 func createTestWorkspace() (string, error) {
 	dst, err := os.MkdirTemp("", "test-")
 	if err != nil {
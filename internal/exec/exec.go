@@ -2,20 +2,38 @@ package exec
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/mitchelldw01/omnirepo/internal/cache"
 	"github.com/mitchelldw01/omnirepo/internal/graph"
 	"github.com/mitchelldw01/omnirepo/internal/log"
+	"github.com/mitchelldw01/omnirepo/internal/trace"
+	"github.com/mitchelldw01/omnirepo/usercfg"
+)
+
+var (
+	// Returned when finalizing the results of a run in which one or more tasks failed.
+	ErrTaskFailure = errors.New("one or more tasks failed")
+	// Returned when finalizing the results of a run that was interrupted.
+	ErrInterrupted = errors.New("run was interrupted, the cache was not updated")
 )
 
 type CacheReader interface {
 	GetCachedResult(dir, name string) (cache.TaskResult, error)
+	GetDurations() (map[string]time.Duration, error)
+	GetFingerprint(node *graph.Node) string
+	RestoreOutputs(node *graph.Node) error
 	Validate(node *graph.Node, deps map[string]struct{}) (bool, error)
+	Discard(node *graph.Node)
 }
 
 type CacheWriter interface {
@@ -23,111 +41,322 @@ type CacheWriter interface {
 	Update() error
 }
 
+// Receives the result of every task and writes a report once the run is finalized.
+type Reporter interface {
+	TaskFinished(node *graph.Node, isClean bool, res cache.TaskResult)
+	TaskSkipped(node *graph.Node)
+	// The cache isn't updated when the run is interrupted, the cache isn't written, or the update fails
+	Finalize(duration time.Duration, cacheUpdated bool) error
+}
+
 type Executor struct {
 	reader CacheReader
-	writer CacheWriter
-	stats  *statistics
+	// Nil when the results of tasks aren't written to the cache
+	writer    CacheWriter
+	reporters []Reporter
+	stats     *statistics
+	// Stops scheduling new tasks and kills running tasks after the first failure
+	failFast bool
+	// Cancelled when running tasks should be killed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Task commands that are currently running
+	procs       *processSet
+	interrupted atomic.Bool
 }
 
-func NewExecutor(cr CacheReader, cw CacheWriter) *Executor {
+func NewExecutor(cr CacheReader, cw CacheWriter, failFast bool) *Executor {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Executor{
-		reader: cr,
-		writer: cw,
-		stats:  newStatistics(),
+		reader:   cr,
+		writer:   cw,
+		stats:    newStatistics(),
+		failFast: failFast,
+		ctx:      ctx,
+		cancel:   cancel,
+		procs:    newProcessSet(),
 	}
 }
 
+// Must be called before any tasks are executed.
+func (e *Executor) AddReporter(r Reporter) {
+	e.reporters = append(e.reporters, r)
+}
+
+// Stops scheduling new tasks and sends the signal to every running task.
+// Tasks that are still running after the grace period are killed.
+func (e *Executor) Interrupt(sig os.Signal, grace time.Duration) {
+	e.interrupted.Store(true)
+	e.procs.signal(sig)
+	time.AfterFunc(grace, e.Kill)
+}
+
+// Stops scheduling new tasks and kills every running task immediately.
+func (e *Executor) Kill() {
+	e.interrupted.Store(true)
+	e.killRunningTasks()
+}
+
+// Processes spawned by a task can outlive the task's shell, so the whole process group is killed.
+func (e *Executor) killRunningTasks() {
+	e.cancel()
+	e.procs.signal(os.Kill)
+}
+
+func (e *Executor) isStopped() bool {
+	return e.interrupted.Load() || e.ctx.Err() != nil
+}
+
 func (e *Executor) ExecuteTask(node *graph.Node, deps map[string]struct{}) {
+	node.Span = trace.Start(node.Id)
+	node.Span.SetAttribute("dir", node.Dir)
+	node.Span.SetAttribute("task", node.Name)
+	defer node.Span.End()
+
+	if e.isStopped() {
+		log.Debug("skipped task", "task", node.Id, "reason", "the run was stopped")
+		e.skipTask(node)
+		return
+	}
 	if e.hasFailedDependency(deps) {
+		log.Debug("skipped task", "task", node.Id, "reason", "a dependency failed or was skipped")
+		e.skipTask(node)
 		return
 	}
 
+	log.TaskStarted(node.Id)
 	if err := e.executeTaskHelper(node, deps); err != nil {
 		e.stats.errors.append(err)
 	}
 }
 
+// Skipped dependencies count as failures so that the whole branch is skipped.
 func (e *Executor) hasFailedDependency(deps map[string]struct{}) bool {
 	for id := range deps {
-		if e.stats.failed.contains(id) {
+		if e.stats.failed.contains(id) || e.stats.skipped.contains(id) {
 			return true
 		}
 	}
 	return false
 }
 
+func (e *Executor) skipTask(node *graph.Node) {
+	node.Span.SetAttribute("status", "skipped")
+	e.stats.skipped.put(node.Id, struct{}{})
+	log.TaskSkipped(node.Id)
+	for _, r := range e.reporters {
+		r.TaskSkipped(node)
+	}
+}
+
+// Returns the durations of tasks from previous runs, mapped by node ID.
+func (e *Executor) GetDurations() map[string]time.Duration {
+	durations, err := e.reader.GetDurations()
+	if err != nil {
+		e.stats.errors.append(err)
+		return map[string]time.Duration{}
+	}
+	return durations
+}
+
 func (e *Executor) executeTaskHelper(node *graph.Node, deps map[string]struct{}) error {
 	valid, err := e.reader.Validate(node, deps)
 	if err != nil {
 		return err
 	}
+	log.TaskCache(node.Id, valid, e.reader.GetFingerprint(node))
 
 	var res cache.TaskResult
+	var signalled bool
 	if valid {
-		res, err = e.reader.GetCachedResult(node.Dir, node.Name)
+		res, err = e.getCachedResult(node)
 	} else {
-		res = e.executeTaskCommand(node.Pipeline.Command, node.Dir)
+		res, signalled = e.executeTaskCommand(node)
 	}
 	if err != nil {
 		return err
 	}
 
+	// The task was killed because another task failed or omni was interrupted,
+	// so its result shouldn't be cached. Tasks that failed on their own are still reported.
+	if res.Failed && signalled {
+		e.reader.Discard(node)
+		e.skipTask(node)
+		return nil
+	}
+
 	return e.processTaskResult(node, valid, res)
 }
 
+// The outputs are restored before the result is returned, so that dependents can use them.
+func (e *Executor) getCachedResult(node *graph.Node) (cache.TaskResult, error) {
+	res, err := e.reader.GetCachedResult(node.Dir, node.Name)
+	if err != nil {
+		return cache.TaskResult{}, err
+	}
+	return res, e.reader.RestoreOutputs(node)
+}
+
 func (e *Executor) processTaskResult(node *graph.Node, isClean bool, res cache.TaskResult) error {
+	node.Span.SetAttribute("cacheHit", isClean)
+	node.Span.SetAttribute("exitCode", res.ExitCode)
+	node.Span.SetAttribute("status", "passed")
 	e.stats.total.increment()
 	if res.Failed {
-		e.stats.failed.put(node.Id)
+		node.Span.SetAttribute("status", "failed")
+		node.Span.SetError(fmt.Sprintf("task exited with code %d", res.ExitCode))
+		e.stats.failed.put(node.Id, res.Logs)
+		if e.failFast {
+			e.killRunningTasks()
+		}
 	}
 
-	var logs string
-	if isClean {
-		logs = "cache hit, replaying logs...\n" + res.Logs
-	} else {
-		logs = "cache miss, executing task...\n" + res.Logs
+	e.printTaskLogs(node, isClean, res)
+	log.TaskFinished(node.Id, isClean, res.ExitCode, res.Duration)
+	for _, r := range e.reporters {
+		r.TaskFinished(node, isClean, res)
 	}
-
-	log.TaskOutput(node.Id, logs)
 	if isClean {
 		e.stats.hits.increment()
 		return nil
 	}
+	if e.writer == nil {
+		return nil
+	}
 
 	return e.writer.WriteTaskResult(node.Dir, node.Name, res)
 }
 
-func (e *Executor) executeTaskCommand(command, dir string) cache.TaskResult {
+// Prints the logs of a task according to its output logs mode.
+// Streamed logs have already been printed while the task was running.
+func (e *Executor) printTaskLogs(node *graph.Node, isClean bool, res cache.TaskResult) {
+	mode := node.Pipeline.OutputLogs
+	showLogs := mode == "" || mode == usercfg.FullLogs ||
+		(mode == usercfg.NewOnlyLogs && !isClean) ||
+		(mode == usercfg.ErrorsOnlyLogs && res.Failed)
+
+	status := "cache miss"
+	if isClean {
+		status = "cache hit"
+	}
+
+	switch {
+	case showLogs && isClean:
+		log.TaskOutput(node.Id, status+", replaying logs...", res.Logs)
+	case showLogs && !e.isStreamed(node):
+		log.TaskOutput(node.Id, status+", executing task...", res.Logs)
+	case !showLogs && (mode == usercfg.HashOnlyLogs || mode == usercfg.NewOnlyLogs):
+		log.TaskStatus(node.Id, status+", suppressing logs "+e.reader.GetFingerprint(node))
+	}
+}
+
+// Logs can only be streamed when they're printed regardless of whether the task fails.
+func (e *Executor) isStreamed(node *graph.Node) bool {
+	if log.Output != log.Stream {
+		return false
+	}
+
+	mode := node.Pipeline.OutputLogs
+	return mode == "" || mode == usercfg.FullLogs || mode == usercfg.NewOnlyLogs
+}
+
+// Also returns true when the command was signalled, because another task failed or omni was interrupted.
+func (e *Executor) executeTaskCommand(node *graph.Node) (cache.TaskResult, bool) {
+	command, dir := node.Pipeline.Command, node.Dir
 	var cmd *exec.Cmd
 	switch runtime.GOOS {
 	case "windows":
-		cmd = exec.Command("powershell", "-NoProfile", "-Command", command)
+		cmd = exec.CommandContext(e.ctx, "powershell", "-NoProfile", "-Command", command)
 	default:
-		cmd = exec.Command("bash", "-c", command)
+		cmd = exec.CommandContext(e.ctx, "bash", "-c", command)
 	}
 
+	// The complete logs are always buffered so that they can be cached
 	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	cmd.Stderr = &buf
+	var out io.Writer = &buf
+	if e.isStreamed(node) {
+		tw := log.NewTaskWriter(node.Id)
+		tw.Status("cache miss, executing task...")
+		defer tw.Flush()
+		out = io.MultiWriter(&buf, tw)
+	}
+
+	cmd.Stdout = out
+	cmd.Stderr = out
 	cmd.Dir = dir
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return signalProcessGroup(cmd, os.Kill)
+	}
+
+	span := node.Span.Start("execute")
+	defer span.End()
 
-	err := cmd.Run()
-	return cache.NewTaskResult(strings.TrimSpace(buf.String()), err != nil)
+	start := time.Now()
+	err := cmd.Start()
+	// A command that can't start because the run was already stopped counts as signalled
+	signalled := err != nil && e.ctx.Err() != nil
+	if err == nil {
+		e.procs.add(cmd)
+		err = cmd.Wait()
+		signalled = e.procs.remove(cmd)
+	}
+
+	return cache.NewTaskResult(strings.TrimSpace(buf.String()), exitCode(err), time.Since(start)), signalled
 }
 
-func (e *Executor) FinalizeResults(t time.Time) {
-	if err := e.writer.Update(); err != nil {
-		e.stats.errors.append(err)
+// Commands that couldn't be started don't have an exit code, so -1 is used instead.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// Updates the cache and prints the metrics for the run.
+// ErrInterrupted takes priority over errors encountered while running tasks,
+// which take priority over ErrTaskFailure.
+func (e *Executor) FinalizeResults(t time.Time) error {
+	// The results of an interrupted run are incomplete, so the cache is left untouched
+	interrupted := e.interrupted.Load()
+	cacheUpdated := false
+	if !interrupted && e.writer != nil {
+		if err := e.writer.Update(); err != nil {
+			e.stats.errors.append(err)
+		} else {
+			cacheUpdated = true
+		}
+	}
+
+	if len(e.stats.failed.val) > 0 {
+		log.Failures(e.stats.failed.val)
 	}
 
 	hits := e.stats.hits.val
 	total := e.stats.total.val
 	failed := len(e.stats.failed.val)
+	skipped := len(e.stats.skipped.val)
 	duration := time.Since(t)
-	log.Metrics(hits, total, failed, duration)
+	for _, r := range e.reporters {
+		if err := r.Finalize(duration, cacheUpdated); err != nil {
+			e.stats.errors.append(err)
+		}
+	}
+	log.Metrics(hits, total, failed, skipped, duration)
 
-	for _, err := range e.stats.errors.val {
-		fmt.Print("\n")
-		log.Error(err)
+	if interrupted {
+		return ErrInterrupted
+	}
+	if len(e.stats.errors.val) > 0 {
+		return errors.Join(e.stats.errors.val...)
+	}
+	if failed > 0 {
+		return ErrTaskFailure
 	}
+	return nil
 }
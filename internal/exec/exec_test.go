@@ -1,34 +1,106 @@
 package exec_test
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mitchelldw01/omnirepo/internal/cache"
 	"github.com/mitchelldw01/omnirepo/internal/exec"
 	"github.com/mitchelldw01/omnirepo/internal/graph"
+	"github.com/mitchelldw01/omnirepo/internal/log"
 	"github.com/mitchelldw01/omnirepo/usercfg"
 )
 
-type reader struct{}
+type reader struct {
+	// Whether every task hits the cache, and the result that is replayed when it does
+	valid     bool
+	result    cache.TaskResult
+	discarded []string
+	// Called before a node is validated, e.g. to hold it back until another task finished
+	validating func(node *graph.Node)
+	mutex      sync.Mutex
+}
 
 func (r *reader) GetCachedResult(dir, name string) (cache.TaskResult, error) {
-	return cache.TaskResult{}, nil
+	return r.result, nil
+}
+
+func (r *reader) GetDurations() (map[string]time.Duration, error) {
+	return map[string]time.Duration{}, nil
+}
+
+func (r *reader) GetFingerprint(node *graph.Node) string {
+	return "fingerprint"
+}
+
+func (r *reader) RestoreOutputs(node *graph.Node) error {
+	return nil
 }
 
 func (r *reader) Validate(node *graph.Node, deps map[string]struct{}) (bool, error) {
-	return false, nil
+	if r.validating != nil {
+		r.validating(node)
+	}
+	return r.valid, nil
+}
+
+func (r *reader) Discard(node *graph.Node) {
+	r.mutex.Lock()
+	r.discarded = append(r.discarded, node.Id)
+	r.mutex.Unlock()
 }
 
 type writer struct {
-	failed bool
+	logs     string
+	failed   bool
+	exitCode int
+	written  int
+	updated  bool
+	mutex    sync.Mutex
 }
 
 func (w *writer) WriteTaskResult(dir, name string, res cache.TaskResult) error {
+	w.mutex.Lock()
+	w.logs = res.Logs
 	w.failed = res.Failed
+	w.exitCode = res.ExitCode
+	w.written++
+	w.mutex.Unlock()
 	return nil
 }
 
 func (w *writer) Update() error {
+	w.updated = true
+	return nil
+}
+
+type reporter struct {
+	finished     []string
+	skipped      []string
+	finalized    bool
+	cacheUpdated bool
+}
+
+func (r *reporter) TaskFinished(node *graph.Node, isClean bool, res cache.TaskResult) {
+	r.finished = append(r.finished, node.Id)
+}
+
+func (r *reporter) TaskSkipped(node *graph.Node) {
+	r.skipped = append(r.skipped, node.Id)
+}
+
+func (r *reporter) Finalize(duration time.Duration, cacheUpdated bool) error {
+	r.finalized = true
+	r.cacheUpdated = cacheUpdated
 	return nil
 }
 
@@ -37,6 +109,7 @@ func TestExecTask(t *testing.T) {
 		name     string
 		cmd      string
 		expected bool
+		exitCode int
 	}{
 		{
 			name: "command should exit cleanly",
@@ -46,13 +119,20 @@ func TestExecTask(t *testing.T) {
 			name:     "command should not exit cleanly",
 			cmd:      "exit 1",
 			expected: true,
+			exitCode: 1,
+		},
+		{
+			name:     "command should record its exit code",
+			cmd:      "exit 3",
+			expected: true,
+			exitCode: 3,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			w := writer{}
-			ex := exec.NewExecutor(&reader{}, &w)
+			ex := exec.NewExecutor(&reader{}, &w, false)
 
 			ex.ExecuteTask(graph.NewNode("", "", usercfg.PipelineConfig{
 				Command: tc.cmd,
@@ -61,6 +141,410 @@ func TestExecTask(t *testing.T) {
 			if tc.expected != w.failed {
 				t.Fatalf("expected %v, got %v", tc.expected, w.failed)
 			}
+			if tc.exitCode != w.exitCode {
+				t.Fatalf("expected exit code %d, got %d", tc.exitCode, w.exitCode)
+			}
+		})
+	}
+}
+
+func TestExecTaskStream(t *testing.T) {
+	log.Output = log.Stream
+	defer func() {
+		log.Output = log.Grouped
+	}()
+
+	w := writer{}
+	ex := exec.NewExecutor(&reader{}, &w, false)
+	ex.ExecuteTask(graph.NewNode("", "", usercfg.PipelineConfig{
+		Command: "echo foo; echo bar >&2",
+	}), map[string]struct{}{})
+
+	if expected := "foo\nbar"; w.logs != expected {
+		t.Fatalf("expected %q, got %q", expected, w.logs)
+	}
+}
+
+func TestExecTaskOutputLogs(t *testing.T) {
+	log.NoColor = true
+	defer func() {
+		log.NoColor = false
+	}()
+
+	hitLogs := "foo:test: cache hit, replaying logs...\nfoo:test: foo\n"
+	missLogs := "foo:test: cache miss, executing task...\nfoo:test: foo\n"
+	hitHash := "foo:test: cache hit, suppressing logs fingerprint\n"
+	missHash := "foo:test: cache miss, suppressing logs fingerprint\n"
+
+	// The expected output of a cache hit, a cache miss, and a failed cache miss for every mode
+	testCases := []struct {
+		mode     string
+		expected [3]string
+	}{
+		{mode: "", expected: [3]string{hitLogs, missLogs, missLogs}},
+		{mode: usercfg.FullLogs, expected: [3]string{hitLogs, missLogs, missLogs}},
+		{mode: usercfg.HashOnlyLogs, expected: [3]string{hitHash, missHash, missHash}},
+		{mode: usercfg.NewOnlyLogs, expected: [3]string{hitHash, missLogs, missLogs}},
+		{mode: usercfg.ErrorsOnlyLogs, expected: [3]string{"", "", missLogs}},
+		{mode: usercfg.NoLogs, expected: [3]string{"", "", ""}},
+	}
+	statuses := [3]string{"hit", "miss", "failed"}
+	commands := [3]string{"echo foo", "echo foo", "echo foo; exit 1"}
+
+	for _, output := range []string{log.Grouped, log.Stream} {
+		for _, tc := range testCases {
+			for i, status := range statuses {
+				name := fmt.Sprintf("mode %q should print the expected logs of a %s when %s", tc.mode, status, output)
+				t.Run(name, func(t *testing.T) {
+					log.Output = output
+					defer func() {
+						log.Output = log.Grouped
+					}()
+
+					node := graph.NewNode("test", "foo", usercfg.PipelineConfig{
+						Command:    commands[i],
+						OutputLogs: tc.mode,
+					})
+					node.Dir = t.TempDir()
+
+					r := reader{valid: status == "hit", result: cache.TaskResult{Logs: "foo"}}
+					ex := exec.NewExecutor(&r, &writer{}, false)
+					res := captureStdout(t, func() {
+						ex.ExecuteTask(node, map[string]struct{}{})
+					})
+
+					if res != tc.expected[i] {
+						t.Fatalf("expected %q, got %q", tc.expected[i], res)
+					}
+				})
+			}
+		}
+	}
+}
+
+func captureStdout(t *testing.T, f func()) string {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	f()
+	w.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read stdout: %v", err)
+	}
+	return string(b)
+}
+
+func TestExecTaskJson(t *testing.T) {
+	log.Format = log.Json
+	defer func() {
+		log.Format = log.Text
+	}()
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	ex := exec.NewExecutor(&reader{}, &writer{}, false)
+	ex.ExecuteTask(graph.NewNode("", "", usercfg.PipelineConfig{
+		Command: "echo foo",
+	}), map[string]struct{}{})
+	w.Close()
+
+	types := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var event struct {
+			Version int    `json:"version"`
+			Type    string `json:"type"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("expected a JSON event, got %q", scanner.Text())
+		}
+		if event.Version != log.SchemaVersion {
+			t.Fatalf("expected version %d, got %d", log.SchemaVersion, event.Version)
+		}
+		types = append(types, event.Type)
+	}
+
+	expected := []string{log.TaskStartedEvent, log.TaskCacheEvent, log.TaskLogEvent, log.TaskFinishedEvent}
+	if !slices.Equal(expected, types) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+}
+
+func TestExecTaskAfterFailure(t *testing.T) {
+	failing := graph.NewNode("fail", "", usercfg.PipelineConfig{Command: "exit 1"})
+	passing := graph.NewNode("pass", "", usercfg.PipelineConfig{Command: "exit 0"})
+
+	t.Run("should skip tasks that depend on a failed task", func(t *testing.T) {
+		w := writer{}
+		ex := exec.NewExecutor(&reader{}, &w, false)
+
+		ex.ExecuteTask(failing, map[string]struct{}{})
+		ex.ExecuteTask(passing, map[string]struct{}{failing.Id: {}})
+
+		if w.written != 1 {
+			t.Fatalf("expected %d task results, got %d", 1, w.written)
+		}
+	})
+
+	t.Run("should continue unrelated tasks when fail-fast is disabled", func(t *testing.T) {
+		w := writer{}
+		ex := exec.NewExecutor(&reader{}, &w, false)
+
+		ex.ExecuteTask(failing, map[string]struct{}{})
+		ex.ExecuteTask(passing, map[string]struct{}{})
+
+		if w.written != 2 {
+			t.Fatalf("expected %d task results, got %d", 2, w.written)
+		}
+	})
+
+	t.Run("should skip unrelated tasks when fail-fast is enabled", func(t *testing.T) {
+		w := writer{}
+		ex := exec.NewExecutor(&reader{}, &w, true)
+
+		ex.ExecuteTask(failing, map[string]struct{}{})
+		ex.ExecuteTask(passing, map[string]struct{}{})
+
+		if w.written != 1 {
+			t.Fatalf("expected %d task results, got %d", 1, w.written)
+		}
+	})
+
+	t.Run("should kill running tasks when fail-fast is enabled", func(t *testing.T) {
+		r, w := reader{}, writer{}
+		ex := exec.NewExecutor(&r, &w, true)
+		sleeping := graph.NewNode("sleep", "", usercfg.PipelineConfig{Command: "sleep 10"})
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		start := time.Now()
+		go func() {
+			defer wg.Done()
+			ex.ExecuteTask(sleeping, map[string]struct{}{})
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		ex.ExecuteTask(failing, map[string]struct{}{})
+		wg.Wait()
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("expected running task to be killed, took %v", elapsed)
+		}
+		if w.written != 1 {
+			t.Fatalf("expected %d task results, got %d", 1, w.written)
+		}
+		if len(r.discarded) != 1 || r.discarded[0] != sleeping.Id {
+			t.Fatalf("expected %q to be discarded, got %v", sleeping.Id, r.discarded)
+		}
+	})
+
+	t.Run("should report tasks that fail on their own after fail-fast stops the run", func(t *testing.T) {
+		first := graph.NewNode("first", "", usercfg.PipelineConfig{})
+		second := graph.NewNode("second", "", usercfg.PipelineConfig{})
+		// The second task replays a failed result from the cache once the first task has stopped the run
+		validating, stopped := make(chan struct{}), make(chan struct{})
+		r := reader{valid: true, result: cache.NewTaskResult("failed", 1, time.Second)}
+		r.validating = func(node *graph.Node) {
+			if node.Id == second.Id {
+				close(validating)
+				<-stopped
+			}
+		}
+		rep := reporter{}
+		ex := exec.NewExecutor(&r, &writer{}, true)
+		ex.AddReporter(&rep)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ex.ExecuteTask(second, map[string]struct{}{})
+		}()
+
+		<-validating
+		ex.ExecuteTask(first, map[string]struct{}{})
+		close(stopped)
+		wg.Wait()
+
+		if len(rep.finished) != 2 || len(rep.skipped) != 0 {
+			t.Fatalf("expected 2 failed tasks and none skipped, got %v finished and %v skipped", rep.finished, rep.skipped)
+		}
+		if len(r.discarded) != 0 {
+			t.Fatalf("expected no tasks to be discarded, got %v", r.discarded)
+		}
+	})
+}
+
+func TestReporter(t *testing.T) {
+	failing := graph.NewNode("fail", "", usercfg.PipelineConfig{Command: "exit 1"})
+	skipped := graph.NewNode("skip", "", usercfg.PipelineConfig{Command: "exit 0"})
+
+	r := reporter{}
+	ex := exec.NewExecutor(&reader{}, &writer{}, false)
+	ex.AddReporter(&r)
+
+	ex.ExecuteTask(failing, map[string]struct{}{})
+	ex.ExecuteTask(skipped, map[string]struct{}{failing.Id: {}})
+	if err := ex.FinalizeResults(time.Now()); !errors.Is(err, exec.ErrTaskFailure) {
+		t.Fatalf("expected %v, got %v", exec.ErrTaskFailure, err)
+	}
+
+	if !slices.Equal(r.finished, []string{failing.Id}) || !slices.Equal(r.skipped, []string{skipped.Id}) {
+		t.Fatalf("expected %q to finish and %q to be skipped, got %v and %v", failing.Id, skipped.Id, r.finished, r.skipped)
+	}
+	if !r.finalized {
+		t.Fatal("expected the reporter to be finalized")
+	}
+}
+
+func TestFinalizeResults(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cmd      string
+		expected error
+	}{
+		{
+			name: "should return nil when all tasks pass",
+			cmd:  "exit 0",
+		},
+		{
+			name:     "should return an error when a task fails",
+			cmd:      "exit 1",
+			expected: exec.ErrTaskFailure,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ex := exec.NewExecutor(&reader{}, &writer{}, false)
+			ex.ExecuteTask(graph.NewNode("", "", usercfg.PipelineConfig{
+				Command: tc.cmd,
+			}), map[string]struct{}{})
+
+			if err := ex.FinalizeResults(time.Now()); !errors.Is(err, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, err)
+			}
 		})
 	}
 }
+
+func TestFinalizeResultsWithoutWriter(t *testing.T) {
+	ex := exec.NewExecutor(&reader{}, nil, false)
+	r := reporter{}
+	ex.AddReporter(&r)
+	ex.ExecuteTask(graph.NewNode("", "", usercfg.PipelineConfig{
+		Command: "exit 0",
+	}), map[string]struct{}{})
+
+	if err := ex.FinalizeResults(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if r.cacheUpdated {
+		t.Fatal("expected the cache not to be updated")
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	w := writer{}
+	ex := exec.NewExecutor(&reader{}, &w, false)
+	// The child process ignores the interrupt, so it must be killed after the grace period
+	node := graph.NewNode("", "", usercfg.PipelineConfig{
+		Command: "trap '' INT; sleep 10 & wait",
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	start := time.Now()
+	go func() {
+		defer wg.Done()
+		ex.ExecuteTask(node, map[string]struct{}{})
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	ex.Interrupt(os.Interrupt, 100*time.Millisecond)
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected running task to be killed, took %v", elapsed)
+	}
+	if err := ex.FinalizeResults(start); !errors.Is(err, exec.ErrInterrupted) {
+		t.Fatalf("expected %v, got %v", exec.ErrInterrupted, err)
+	}
+	if w.written != 0 || w.updated {
+		t.Fatal("expected the cache to be left untouched")
+	}
+}
+
+func TestPlanner(t *testing.T) {
+	log.Format = log.Json
+	defer func() {
+		log.Format = log.Text
+	}()
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	path := filepath.Join(t.TempDir(), "executed")
+	p := exec.NewPlanner(&reader{})
+	p.ExecuteTask(graph.NewNode("test", "foo", usercfg.PipelineConfig{
+		Command: "touch " + path,
+	}), map[string]struct{}{})
+	if err := p.FinalizeResults(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("expected the task not to be executed")
+	}
+
+	var planned struct {
+		Data struct {
+			Hits   []string `json:"hits"`
+			Misses []string `json:"misses"`
+		} `json:"data"`
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("expected a JSON event, got %q", scanner.Text())
+		}
+		if event.Type != log.RunPlannedEvent {
+			continue
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &planned); err != nil {
+			t.Fatalf("failed to unmarshal %s event: %v", event.Type, err)
+		}
+	}
+
+	if len(planned.Data.Hits) != 0 || !slices.Equal([]string{"foo:test"}, planned.Data.Misses) {
+		t.Fatalf("expected %q to be a planned miss, got %+v", "foo:test", planned.Data)
+	}
+}
@@ -0,0 +1,127 @@
+package exec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+	"github.com/mitchelldw01/omnirepo/internal/graph"
+	"github.com/mitchelldw01/omnirepo/internal/log"
+)
+
+type CacheExplainer interface {
+	Validate(node *graph.Node, deps map[string]struct{}) (bool, error)
+	Explain(node *graph.Node, deps map[string]struct{}) (cache.Explanation, error)
+}
+
+// Validates the dependencies of a task without running anything,
+// then explains why the task would miss the cache.
+type Explainer struct {
+	reader CacheExplainer
+	// The ID of the node that is explained
+	id     string
+	expl   *cache.Explanation
+	errors *errorStatistic
+}
+
+func NewExplainer(cr CacheExplainer, id string) *Explainer {
+	return &Explainer{
+		reader: cr,
+		id:     id,
+		errors: newErrorMetric(),
+	}
+}
+
+func (e *Explainer) ExecuteTask(node *graph.Node, deps map[string]struct{}) {
+	if node.Id != e.id {
+		if _, err := e.reader.Validate(node, deps); err != nil {
+			e.errors.append(err)
+		}
+		return
+	}
+
+	expl, err := e.reader.Explain(node, deps)
+	if err != nil {
+		e.errors.append(err)
+		return
+	}
+	e.expl = &expl
+}
+
+// Durations aren't needed because nothing is executed.
+func (e *Explainer) GetDurations() map[string]time.Duration {
+	return map[string]time.Duration{}
+}
+
+func (e *Explainer) FinalizeResults(_ time.Time) error {
+	if len(e.errors.val) > 0 {
+		return errors.Join(e.errors.val...)
+	}
+	if e.expl == nil {
+		return fmt.Errorf("failed to explain task %q", e.id)
+	}
+
+	if log.Format == log.Json {
+		b, err := json.Marshal(e.expl)
+		if err != nil {
+			return fmt.Errorf("failed to marshal explanation: %v", err)
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	printExplanation(*e.expl)
+	return nil
+}
+
+func printExplanation(expl cache.Explanation) {
+	if expl.Valid {
+		fmt.Printf("%s would hit the cache.\n", colorize(log.Green, expl.Id))
+		return
+	}
+
+	fmt.Printf("%s would miss the cache:\n", colorize(log.Red, expl.Id))
+	if expl.NoCache {
+		fmt.Println("    reading the cache is disabled")
+	}
+	for _, id := range expl.InvalidDependencies {
+		fmt.Printf("    dependency %s would miss the cache\n", id)
+	}
+	if expl.MissingCache {
+		fmt.Println("    the task has no previous cache entry to compare against")
+	}
+	if expl.VersionChanged {
+		fmt.Println("    the version of omni changed")
+	}
+	if expl.CommandChanged {
+		fmt.Println("    the command changed")
+	}
+	if expl.OutputsChanged {
+		fmt.Println("    the output patterns changed")
+	}
+	for _, name := range expl.EnvChanged {
+		fmt.Printf("    environment variable %s changed\n", name)
+	}
+	for _, id := range expl.DependenciesChanged {
+		fmt.Printf("    the outputs of dependency %s changed\n", id)
+	}
+
+	for _, path := range expl.Added {
+		fmt.Printf("    %s %s\n", colorize(log.Green, "added:  "), path)
+	}
+	for _, path := range expl.Removed {
+		fmt.Printf("    %s %s\n", colorize(log.Red, "removed:"), path)
+	}
+	for _, path := range expl.Changed {
+		fmt.Printf("    %s %s\n", colorize(log.Yellow, "changed:"), path)
+	}
+}
+
+func colorize(code, s string) string {
+	if log.NoColor {
+		return s
+	}
+	return code + s + log.Reset
+}
@@ -0,0 +1,80 @@
+package exec
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/graph"
+	"github.com/mitchelldw01/omnirepo/internal/log"
+)
+
+type CacheValidator interface {
+	Validate(node *graph.Node, deps map[string]struct{}) (bool, error)
+	GetFingerprint(node *graph.Node) string
+}
+
+// Validates every task in dependency order without executing anything,
+// and reports which tasks would replay from the cache and which would execute.
+// Dependents of predicted misses are predicted to miss as well, since the outputs of their dependencies
+// aren't known until they execute.
+type Planner struct {
+	reader CacheValidator
+	hits   *mapStatistic[struct{}]
+	misses *mapStatistic[struct{}]
+	errors *errorStatistic
+}
+
+func NewPlanner(cv CacheValidator) *Planner {
+	return &Planner{
+		reader: cv,
+		hits:   newMapMetric[struct{}](),
+		misses: newMapMetric[struct{}](),
+		errors: newErrorMetric(),
+	}
+}
+
+func (p *Planner) ExecuteTask(node *graph.Node, deps map[string]struct{}) {
+	valid, err := p.reader.Validate(node, deps)
+	if err != nil {
+		p.errors.append(err)
+		return
+	}
+	for id := range deps {
+		if p.misses.contains(id) {
+			valid = false
+		}
+	}
+	log.TaskCache(node.Id, valid, p.reader.GetFingerprint(node))
+
+	if valid {
+		p.hits.put(node.Id, struct{}{})
+		log.TaskStatus(node.Id, "cache hit, would replay logs")
+		return
+	}
+	p.misses.put(node.Id, struct{}{})
+	log.TaskStatus(node.Id, "cache miss, would execute task")
+}
+
+// Durations aren't needed because nothing is executed.
+func (p *Planner) GetDurations() map[string]time.Duration {
+	return map[string]time.Duration{}
+}
+
+func (p *Planner) FinalizeResults(t time.Time) error {
+	if len(p.errors.val) > 0 {
+		return errors.Join(p.errors.val...)
+	}
+
+	log.Plan(sortedKeys(p.hits.val), sortedKeys(p.misses.val), time.Since(t))
+	return nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
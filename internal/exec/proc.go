@@ -0,0 +1,60 @@
+package exec
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// Set of task commands that are currently running.
+type processSet struct {
+	cmds map[*exec.Cmd]struct{}
+	// Commands that were sent a signal, so that their failures aren't mistaken for failures of their own
+	signalled map[*exec.Cmd]struct{}
+	// The last signal that was sent, which is also sent to commands that start afterwards
+	sig   os.Signal
+	mutex sync.Mutex
+}
+
+func newProcessSet() *processSet {
+	return &processSet{
+		cmds:      map[*exec.Cmd]struct{}{},
+		signalled: map[*exec.Cmd]struct{}{},
+		mutex:     sync.Mutex{},
+	}
+}
+
+func (ps *processSet) add(cmd *exec.Cmd) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.cmds[cmd] = struct{}{}
+	if ps.sig != nil {
+		ps.signalled[cmd] = struct{}{}
+		_ = signalProcessGroup(cmd, ps.sig)
+	}
+}
+
+// Returns true when the command was sent a signal while it was running.
+func (ps *processSet) remove(cmd *exec.Cmd) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	_, ok := ps.signalled[cmd]
+	delete(ps.cmds, cmd)
+	delete(ps.signalled, cmd)
+	return ok
+}
+
+// Sends the signal to the process group of every running command.
+func (ps *processSet) signal(sig os.Signal) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.sig = sig
+	for cmd := range ps.cmds {
+		ps.signalled[cmd] = struct{}{}
+		// The process may have exited since it was added to the set, which is safe to ignore
+		_ = signalProcessGroup(cmd, sig)
+	}
+}
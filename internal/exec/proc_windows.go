@@ -0,0 +1,25 @@
+//go:build windows
+
+package exec
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// Unlike on Unix, Windows can't deliver a signal to a process group, so every signal kills the task.
+// taskkill walks the process tree, so the processes spawned by the task are killed along with its shell.
+// The shell is still killed when taskkill fails.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	if err := kill.Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
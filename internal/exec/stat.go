@@ -3,18 +3,22 @@ package exec
 import "sync"
 
 type statistics struct {
-	hits   *intStatistic
-	total  *intStatistic
-	failed *mapStatistic
-	errors *errorStatistic
+	hits  *intStatistic
+	total *intStatistic
+	// Map from the IDs of failed tasks to their logs
+	failed *mapStatistic[string]
+	// Tasks that were not executed, or were killed, because another task failed
+	skipped *mapStatistic[struct{}]
+	errors  *errorStatistic
 }
 
 func newStatistics() *statistics {
 	return &statistics{
-		hits:   newIntMetric(),
-		total:  newIntMetric(),
-		failed: newMapMetric(),
-		errors: newErrorMetric(),
+		hits:    newIntMetric(),
+		total:   newIntMetric(),
+		failed:  newMapMetric[string](),
+		skipped: newMapMetric[struct{}](),
+		errors:  newErrorMetric(),
 	}
 }
 
@@ -35,28 +39,28 @@ func (m *intStatistic) increment() {
 	m.mutex.Unlock()
 }
 
-type mapStatistic struct {
-	val   map[string]struct{}
+type mapStatistic[T any] struct {
+	val   map[string]T
 	mutex sync.Mutex
 }
 
-func newMapMetric() *mapStatistic {
-	return &mapStatistic{
-		val:   map[string]struct{}{},
+func newMapMetric[T any]() *mapStatistic[T] {
+	return &mapStatistic[T]{
+		val:   map[string]T{},
 		mutex: sync.Mutex{},
 	}
 }
 
-func (m *mapStatistic) contains(key string) bool {
+func (m *mapStatistic[T]) contains(key string) bool {
 	m.mutex.Lock()
 	_, ok := m.val[key]
 	m.mutex.Unlock()
 	return ok
 }
 
-func (m *mapStatistic) put(key string) {
+func (m *mapStatistic[T]) put(key string, val T) {
 	m.mutex.Lock()
-	m.val[key] = struct{}{}
+	m.val[key] = val
 	m.mutex.Unlock()
 }
 
@@ -13,9 +13,11 @@ import (
 
 // Both executes task commands and finalizes the task results.
 // Finalizing results consists of creating the final cache artifacts and printing metrics.
+// The durations of tasks from previous runs are used to prioritize the critical path.
 type Executor interface {
 	ExecuteTask(node *Node, deps map[string]struct{})
-	FinalizeResults(t time.Time)
+	FinalizeResults(t time.Time) error
+	GetDurations() map[string]time.Duration
 }
 
 type DependencyGraph struct {
@@ -24,14 +26,17 @@ type DependencyGraph struct {
 	Dependencies  map[string]map[string]struct{}
 	exec          Executor
 	targetConfigs map[string]usercfg.TargetConfig
+	// The maximum number of tasks that can be executed at the same time
+	concurrency int
 }
 
-func NewDependencyGraph(ex Executor, configs map[string]usercfg.TargetConfig) *DependencyGraph {
+func NewDependencyGraph(ex Executor, configs map[string]usercfg.TargetConfig, concurrency int) *DependencyGraph {
 	return &DependencyGraph{
 		Nodes:         map[string]*Node{},
 		Dependencies:  map[string]map[string]struct{}{},
 		exec:          ex,
 		targetConfigs: configs,
+		concurrency:   max(1, concurrency),
 	}
 }
 
@@ -190,36 +195,98 @@ func (dg *DependencyGraph) pruneDependencyTree(tree map[string]interface{}, dept
 }
 
 // Executes tasks in topological order. The following process is repeated until complete...
-//  1. All nodes with 0 indegree are executed
-//  2. When a task completes, the indegrees of all dependencies are decremented.
-func (dg *DependencyGraph) ExecuteTasks() {
+//  1. All nodes with 0 indegree are added to the ready queue.
+//  2. Nodes in the ready queue are handed to a pool of workers as soon as a worker is free.
+//     Nodes on the longest remaining path through the graph are handed out first.
+//  3. When a task completes, the indegrees of all dependencies are decremented.
+//
+// The error returned by the executor when finalizing the results is returned.
+func (dg *DependencyGraph) ExecuteTasks() error {
 	var wg sync.WaitGroup
-	ch, numActive, t := make(chan string), 0, time.Now()
+	nodes, done, t := make(chan *Node), make(chan string), time.Now()
 
+	for i := 0; i < dg.concurrency; i++ {
+		wg.Add(1)
+		go dg.processNodes(nodes, done, &wg)
+	}
+
+	deps := dg.invertDependencies()
+	queue := newReadyQueue(dg.computeCriticalPaths(deps, dg.exec.GetDurations()))
 	for _, node := range dg.Nodes {
-		if isActive := dg.processNode(node, &wg, ch); isActive {
-			numActive++
+		if node.getIndegree() == 0 {
+			queue.push(node)
 		}
 	}
 
-	deps := dg.invertDependencies()
-	for id := range ch {
-		numActive--
-		for depId := range deps[id] {
-			depNode := dg.Nodes[depId]
-			depNode.decrementIndegree()
-			if isActive := dg.processNode(depNode, &wg, ch); isActive {
-				numActive++
-			}
+	numActive := 0
+	for queue.Len() > 0 || numActive > 0 {
+		// A nil channel blocks forever, so nothing is sent while the queue is empty
+		var next *Node
+		var ch chan *Node
+		if queue.Len() > 0 {
+			next, ch = queue.peek(), nodes
 		}
 
-		if numActive == 0 {
-			close(ch)
+		select {
+		case ch <- next:
+			queue.pop()
+			numActive++
+		case id := <-done:
+			numActive--
+			queue.push(dg.releaseDependents(id, deps)...)
 		}
 	}
 
+	close(nodes)
 	wg.Wait()
-	dg.exec.FinalizeResults(t)
+	return dg.exec.FinalizeResults(t)
+}
+
+// Computes the length of the longest path from each node to the end of the graph.
+// Nodes without a recorded duration are estimated with the average of the recorded durations.
+func (dg *DependencyGraph) computeCriticalPaths(
+	deps map[string]map[string]struct{},
+	durations map[string]time.Duration,
+) map[string]int64 {
+	estimate := int64(1)
+	if len(durations) > 0 {
+		var sum int64
+		for _, d := range durations {
+			sum += int64(d)
+		}
+		estimate = max(1, sum/int64(len(durations)))
+	}
+
+	paths := make(map[string]int64, len(dg.Nodes))
+	for id := range dg.Nodes {
+		dg.computeCriticalPath(id, deps, durations, estimate, paths)
+	}
+	return paths
+}
+
+func (dg *DependencyGraph) computeCriticalPath(
+	id string,
+	deps map[string]map[string]struct{},
+	durations map[string]time.Duration,
+	estimate int64,
+	paths map[string]int64,
+) int64 {
+	if path, ok := paths[id]; ok {
+		return path
+	}
+
+	var longest int64
+	for depId := range deps[id] {
+		longest = max(longest, dg.computeCriticalPath(depId, deps, durations, estimate, paths))
+	}
+
+	duration, ok := durations[id]
+	if !ok {
+		duration = time.Duration(estimate)
+	}
+	paths[id] = longest + int64(duration)
+
+	return paths[id]
 }
 
 func (dg *DependencyGraph) invertDependencies() map[string]map[string]struct{} {
@@ -239,18 +306,28 @@ func (dg *DependencyGraph) invertDependencies() map[string]map[string]struct{} {
 	return dependents
 }
 
-func (dg *DependencyGraph) processNode(node *Node, wg *sync.WaitGroup, ch chan string) bool {
-	if node.getIndegree() != 0 {
-		return false
+// Decrements the indegrees of the nodes that depend on the given node.
+// It returns the nodes that are ready to be executed.
+func (dg *DependencyGraph) releaseDependents(id string, deps map[string]map[string]struct{}) []*Node {
+	ready := []*Node{}
+
+	for depId := range deps[id] {
+		depNode := dg.Nodes[depId]
+		depNode.decrementIndegree()
+		if depNode.getIndegree() == 0 {
+			ready = append(ready, depNode)
+		}
 	}
 
-	wg.Add(1)
-	go func(node *Node) {
-		defer wg.Done()
+	return ready
+}
+
+func (dg *DependencyGraph) processNodes(nodes <-chan *Node, done chan<- string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for node := range nodes {
 		deps := dg.Dependencies[node.Id]
 		dg.exec.ExecuteTask(node, deps)
-		ch <- node.Id
-	}(node)
-
-	return true
+		done <- node.Id
+	}
 }
@@ -1,8 +1,10 @@
 package graph_test
 
 import (
+	"fmt"
 	"reflect"
 	"slices"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,7 +16,44 @@ type executor struct{}
 
 func (e executor) ExecuteTask(node *graph.Node, dependencies map[string]struct{}) {}
 
-func (e executor) FinalizeResults(t time.Time) {}
+func (e executor) FinalizeResults(t time.Time) error {
+	return nil
+}
+
+func (e executor) GetDurations() map[string]time.Duration {
+	return map[string]time.Duration{}
+}
+
+// Records the order that tasks are executed in and the peak number of concurrent tasks.
+type recordingExecutor struct {
+	mutex     sync.Mutex
+	active    int
+	peak      int
+	order     []string
+	durations map[string]time.Duration
+}
+
+func (e *recordingExecutor) ExecuteTask(node *graph.Node, dependencies map[string]struct{}) {
+	e.mutex.Lock()
+	e.active++
+	e.peak = max(e.peak, e.active)
+	e.mutex.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	e.mutex.Lock()
+	e.active--
+	e.order = append(e.order, node.Id)
+	e.mutex.Unlock()
+}
+
+func (e *recordingExecutor) FinalizeResults(t time.Time) error {
+	return nil
+}
+
+func (e *recordingExecutor) GetDurations() map[string]time.Duration {
+	return e.durations
+}
 
 func TestPopulateNodes(t *testing.T) {
 	type expected struct {
@@ -228,7 +267,7 @@ func TestPopulateNodes(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			graph := graph.NewDependencyGraph(executor{}, tc.targetConfigs)
+			graph := graph.NewDependencyGraph(executor{}, tc.targetConfigs, 1)
 			err := graph.PopulateNodes(tc.tasks, tc.dir)
 
 			if tc.expected.err {
@@ -368,7 +407,7 @@ func TestFormat(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			graph := graph.NewDependencyGraph(executor{}, tc.targetConfigs)
+			graph := graph.NewDependencyGraph(executor{}, tc.targetConfigs, 1)
 			if err := graph.PopulateNodes(tc.tasks, ""); err != nil {
 				t.Fatalf("expected nil, got %v", err)
 			}
@@ -380,3 +419,118 @@ func TestFormat(t *testing.T) {
 		})
 	}
 }
+
+func TestExecuteTasks(t *testing.T) {
+	targetConfigs := map[string]usercfg.TargetConfig{
+		"foo": {
+			Dependencies: []string{"bar", "baz", "qux", "quux"},
+			Pipeline: map[string]usercfg.PipelineConfig{
+				"test": {
+					DependsOn: []string{"^test"},
+				},
+			},
+		},
+	}
+	for _, dir := range []string{"bar", "baz", "qux", "quux"} {
+		targetConfigs[dir] = usercfg.TargetConfig{
+			Pipeline: map[string]usercfg.PipelineConfig{
+				"test": {},
+			},
+		}
+	}
+
+	for _, concurrency := range []int{1, 2, 5} {
+		t.Run(fmt.Sprintf("should run at most %d tasks at once", concurrency), func(t *testing.T) {
+			ex := &recordingExecutor{}
+			graph := graph.NewDependencyGraph(ex, targetConfigs, concurrency)
+			if err := graph.PopulateNodes([]string{"test"}, ""); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if err := graph.ExecuteTasks(); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if len(ex.order) != 5 {
+				t.Fatalf("expected %d tasks to execute, got %d", 5, len(ex.order))
+			}
+			if ex.order[len(ex.order)-1] != "foo:test" {
+				t.Errorf("expected %q to execute last, got %v", "foo:test", ex.order)
+			}
+			if ex.peak > concurrency {
+				t.Errorf("expected at most %d concurrent tasks, got %d", concurrency, ex.peak)
+			}
+		})
+	}
+}
+
+func TestExecuteTasksPriority(t *testing.T) {
+	targetConfigs := map[string]usercfg.TargetConfig{
+		"foo": {
+			Dependencies: []string{"bar"},
+			Pipeline: map[string]usercfg.PipelineConfig{
+				"test": {
+					DependsOn: []string{"^test"},
+				},
+			},
+		},
+		"bar": {
+			Pipeline: map[string]usercfg.PipelineConfig{
+				"test": {},
+			},
+		},
+		"baz": {
+			Pipeline: map[string]usercfg.PipelineConfig{
+				"test": {},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name      string
+		durations map[string]time.Duration
+		expected  string
+	}{
+		{
+			name: "should start the longest chain first",
+			durations: map[string]time.Duration{
+				"foo:test": 10 * time.Second,
+				"bar:test": 10 * time.Second,
+				"baz:test": 15 * time.Second,
+			},
+			expected: "bar:test",
+		},
+		{
+			name: "should start a long task before a short chain",
+			durations: map[string]time.Duration{
+				"foo:test": time.Second,
+				"bar:test": time.Second,
+				"baz:test": 10 * time.Second,
+			},
+			expected: "baz:test",
+		},
+		{
+			name:      "should estimate unknown durations",
+			durations: map[string]time.Duration{},
+			expected:  "bar:test",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ex := &recordingExecutor{durations: tc.durations}
+			graph := graph.NewDependencyGraph(ex, targetConfigs, 1)
+			if err := graph.PopulateNodes([]string{"test"}, ""); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if err := graph.ExecuteTasks(); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+
+			if ex.order[0] != tc.expected {
+				t.Fatalf("expected %q to execute first, got %v", tc.expected, ex.order)
+			}
+		})
+	}
+}
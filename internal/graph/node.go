@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/mitchelldw01/omnirepo/internal/trace"
 	"github.com/mitchelldw01/omnirepo/usercfg"
 )
 
@@ -12,6 +13,8 @@ type Node struct {
 	Name     string
 	Dir      string
 	Pipeline usercfg.PipelineConfig
+	// The span of the node's task, which is nil until the task starts or when tracing is disabled
+	Span     *trace.Span
 	mutex    sync.RWMutex
 	indegree int
 }
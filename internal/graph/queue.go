@@ -0,0 +1,58 @@
+package graph
+
+import "container/heap"
+
+// Priority queue of nodes that are ready to be executed.
+// Nodes with the highest priority are popped first, and ties are broken by node ID.
+type readyQueue struct {
+	nodes      []*Node
+	priorities map[string]int64
+}
+
+func newReadyQueue(priorities map[string]int64) *readyQueue {
+	return &readyQueue{
+		nodes:      []*Node{},
+		priorities: priorities,
+	}
+}
+
+func (q *readyQueue) Len() int {
+	return len(q.nodes)
+}
+
+func (q *readyQueue) Less(i, j int) bool {
+	a, b := q.nodes[i], q.nodes[j]
+	if q.priorities[a.Id] != q.priorities[b.Id] {
+		return q.priorities[a.Id] > q.priorities[b.Id]
+	}
+	return a.Id < b.Id
+}
+
+func (q *readyQueue) Swap(i, j int) {
+	q.nodes[i], q.nodes[j] = q.nodes[j], q.nodes[i]
+}
+
+func (q *readyQueue) Push(x any) {
+	q.nodes = append(q.nodes, x.(*Node))
+}
+
+func (q *readyQueue) Pop() any {
+	n := len(q.nodes)
+	node := q.nodes[n-1]
+	q.nodes = q.nodes[:n-1]
+	return node
+}
+
+func (q *readyQueue) push(nodes ...*Node) {
+	for _, node := range nodes {
+		heap.Push(q, node)
+	}
+}
+
+func (q *readyQueue) peek() *Node {
+	return q.nodes[0]
+}
+
+func (q *readyQueue) pop() *Node {
+	return heap.Pop(q).(*Node)
+}
@@ -0,0 +1,136 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// The version of the JSON event schema.
+// It's incremented whenever a field is removed or its meaning changes.
+const SchemaVersion = 1
+
+// Determines how the progress of a run is written to stdout.
+const (
+	// Human readable output
+	Text = "text"
+	// Newline-delimited JSON events
+	Json = "json"
+)
+
+// Types of the events written in the JSON format.
+const (
+	GraphResolvedEvent       = "graph.resolved"
+	TaskStartedEvent         = "task.started"
+	TaskCacheEvent           = "task.cache"
+	TaskLogEvent             = "task.log"
+	TaskFinishedEvent        = "task.finished"
+	TaskSkippedEvent         = "task.skipped"
+	CacheUploadStartedEvent  = "cache.upload.started"
+	CacheUploadFinishedEvent = "cache.upload.finished"
+	RunFinishedEvent         = "run.finished"
+	RunPlannedEvent          = "run.planned"
+)
+
+var Format = Text
+
+type event struct {
+	Version int       `json:"version"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Data    any       `json:"data"`
+}
+
+func isJson() bool {
+	return Format == Json
+}
+
+// Writes a single event as a line of JSON. Events are only written in the JSON format.
+func writeEvent(typ string, data any) {
+	if !isJson() {
+		return
+	}
+
+	mutex.Lock()
+	printEvent(typ, data)
+	mutex.Unlock()
+}
+
+// Must be called while holding the mutex.
+func printEvent(typ string, data any) {
+	b, err := json.Marshal(event{
+		Version: SchemaVersion,
+		Type:    typ,
+		Time:    time.Now().UTC(),
+		Data:    data,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to marshal %s event: %v\n", typ, err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+// Writes the tasks that will run, mapped to the IDs of their dependencies.
+func GraphResolved(deps map[string]map[string]struct{}) {
+	tasks := make(map[string][]string, len(deps))
+	for id, set := range deps {
+		ids := make([]string, 0, len(set))
+		for dep := range set {
+			ids = append(ids, dep)
+		}
+		slices.Sort(ids)
+		tasks[id] = ids
+	}
+
+	writeEvent(GraphResolvedEvent, map[string]any{"tasks": tasks})
+}
+
+func TaskStarted(id string) {
+	writeEvent(TaskStartedEvent, map[string]any{"id": id})
+}
+
+// Writes whether a task was a cache hit, along with the fingerprint of its inputs.
+func TaskCache(id string, hit bool, fingerprint string) {
+	writeEvent(TaskCacheEvent, map[string]any{
+		"id":          id,
+		"status":      cacheStatus(hit),
+		"fingerprint": fingerprint,
+	})
+}
+
+func TaskFinished(id string, hit bool, exitCode int, duration time.Duration) {
+	writeEvent(TaskFinishedEvent, map[string]any{
+		"id":         id,
+		"cache":      cacheStatus(hit),
+		"exitCode":   exitCode,
+		"durationMs": duration.Milliseconds(),
+	})
+}
+
+// Writes that a task was skipped because a dependency failed or the run was stopped.
+func TaskSkipped(id string) {
+	writeEvent(TaskSkippedEvent, map[string]any{"id": id})
+}
+
+func CacheUploadStarted() {
+	writeEvent(CacheUploadStartedEvent, map[string]any{})
+}
+
+// The error is empty when the upload succeeded.
+func CacheUploadFinished(duration time.Duration, err error) {
+	data := map[string]any{"durationMs": duration.Milliseconds(), "error": ""}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	writeEvent(CacheUploadFinishedEvent, data)
+}
+
+func cacheStatus(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
@@ -0,0 +1,83 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Leveled logs are disabled until a level is set.
+const levelOff = slog.LevelError + 1
+
+// The minimum level of leveled log messages, which are written to stderr.
+var level = func() *slog.LevelVar {
+	lvl := new(slog.LevelVar)
+	lvl.Set(levelOff)
+	return lvl
+}()
+
+var (
+	textLogger = slog.New(slog.NewTextHandler(stderr{}, &slog.HandlerOptions{Level: level}))
+	jsonLogger = slog.New(slog.NewJSONHandler(stderr{}, &slog.HandlerOptions{Level: level}))
+)
+
+// Writes to the current os.Stderr, which may be replaced after the loggers are created.
+type stderr struct{}
+
+func (stderr) Write(b []byte) (int, error) {
+	return os.Stderr.Write(b)
+}
+
+// Sets the minimum level of leveled log messages. Accepts debug, info, or warn.
+// Errors are always printed, so there's no error level. An empty name disables leveled logs.
+func SetLevel(name string) error {
+	switch name {
+	case "":
+		level.Set(levelOff)
+	case "debug":
+		level.Set(slog.LevelDebug)
+	case "info":
+		level.Set(slog.LevelInfo)
+	case "warn":
+		level.Set(slog.LevelWarn)
+	default:
+		return fmt.Errorf("invalid log level %q, expected debug, info, or warn", name)
+	}
+	return nil
+}
+
+// Returns true when debug messages are written, so that expensive arguments can be skipped.
+func DebugEnabled() bool {
+	return level.Level() <= slog.LevelDebug
+}
+
+// Writes a debug message followed by alternating keys and values.
+// Debug messages explain decisions, e.g. why a task missed the cache.
+func Debug(msg string, args ...any) {
+	logAt(slog.LevelDebug, msg, args...)
+}
+
+// Writes an info message followed by alternating keys and values.
+// Info messages record notable events, e.g. a cache server evicting an artifact.
+func Info(msg string, args ...any) {
+	logAt(slog.LevelInfo, msg, args...)
+}
+
+// Writes a warning followed by alternating keys and values.
+// Warnings report failures that omni recovered from, e.g. a cache entry without its output archive.
+func Warn(msg string, args ...any) {
+	logAt(slog.LevelWarn, msg, args...)
+}
+
+func logAt(lvl slog.Level, msg string, args ...any) {
+	if level.Level() > lvl {
+		return
+	}
+
+	if isJson() {
+		jsonLogger.Log(context.Background(), lvl, msg, args...)
+		return
+	}
+	textLogger.Log(context.Background(), lvl, msg, args...)
+}
@@ -0,0 +1,98 @@
+package log_test
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mitchelldw01/omnirepo/internal/log"
+)
+
+func TestSetLevel(t *testing.T) {
+	testCases := []struct {
+		name    string
+		level   string
+		isValid bool
+	}{
+		{name: "should accept the debug level", level: "debug", isValid: true},
+		{name: "should accept the info level", level: "info", isValid: true},
+		{name: "should accept the warn level", level: "warn", isValid: true},
+		{name: "should accept an empty level", level: "", isValid: true},
+		{name: "should reject the error level", level: "error"},
+		{name: "should reject unknown levels", level: "verbose"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer log.SetLevel("")
+
+			err := log.SetLevel(tc.level)
+			if tc.isValid && err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			if !tc.isValid && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestLeveledLogs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		level    string
+		expected []string
+	}{
+		{name: "should write nothing by default", level: "", expected: []string{}},
+		{name: "should write warnings at the warn level", level: "warn", expected: []string{"WARN"}},
+		{name: "should write info messages at the info level", level: "info", expected: []string{"INFO", "WARN"}},
+		{name: "should write every message at the debug level", level: "debug", expected: []string{"DEBUG", "INFO", "WARN"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := log.SetLevel(tc.level); err != nil {
+				t.Fatal(err)
+			}
+			defer log.SetLevel("")
+
+			res := captureStderr(t, func() {
+				log.Debug("message", "key", "val")
+				log.Info("message", "key", "val")
+				log.Warn("message", "key", "val")
+			})
+
+			levels := []string{}
+			for _, field := range strings.Fields(res) {
+				if lvl, ok := strings.CutPrefix(field, "level="); ok {
+					levels = append(levels, lvl)
+				}
+			}
+			if strings.Join(levels, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("expected levels %v, got %v", tc.expected, levels)
+			}
+		})
+	}
+}
+
+func captureStderr(t *testing.T, f func()) string {
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = w
+	defer func() {
+		os.Stderr = stderr
+	}()
+
+	f()
+	w.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read stderr: %v", err)
+	}
+	return string(b)
+}
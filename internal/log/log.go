@@ -1,9 +1,11 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -21,8 +23,20 @@ const (
 	Reset     = "\x1b[0m"
 )
 
+// The number of log lines that are replayed for each failed task at the end of a run.
+const failureLines = 10
+
+// Determines when the logs of executed tasks are printed.
+const (
+	// Logs are printed all at once when the task completes
+	Grouped = "grouped"
+	// Logs are printed line by line while the task is running
+	Stream = "stream"
+)
+
 var (
 	NoColor = false
+	Output  = Grouped
 	codes   = [4]string{Yellow, Blue, Magenta, Cyan}
 	index   = 0
 	mutex   = sync.Mutex{}
@@ -33,7 +47,17 @@ func Fatal(v ...any) {
 	os.Exit(1)
 }
 
+// Errors created with errors.Join are printed one per line.
 func Error(v ...any) {
+	if len(v) == 1 {
+		if joined, ok := v[0].(interface{ Unwrap() []error }); ok {
+			for _, err := range joined.Unwrap() {
+				Error(err)
+			}
+			return
+		}
+	}
+
 	prefix := "error: "
 	if !NoColor {
 		prefix = fmt.Sprintf("%s%serror:%s", Red, Bold, Reset)
@@ -45,38 +69,201 @@ func Error(v ...any) {
 	fmt.Fprintln(os.Stderr)
 }
 
-func TaskOutput(id, out string) {
+// Prints the status of a task followed by its logs.
+// In the JSON format, only the logs are written as task.log events.
+func TaskOutput(id, status, logs string) {
+	mutex.Lock()
+	colorCode := nextColorCode()
+
+	printTaskStatus(id, colorCode, status)
+	for _, line := range strings.Split(logs, "\n") {
+		printTaskLine(id, colorCode, line)
+	}
+
+	mutex.Unlock()
+}
+
+// Prints the status of a task without any logs.
+func TaskStatus(id, status string) {
 	mutex.Lock()
+	printTaskStatus(id, nextColorCode(), status)
+	mutex.Unlock()
+}
+
+// Must be called while holding the mutex.
+func nextColorCode() string {
 	colorCode := codes[index]
 	index = (index + 1) % len(codes)
+	return colorCode
+}
+
+// Status lines aren't logs, so they're omitted from the JSON format.
+func printTaskStatus(id, colorCode, status string) {
+	if isJson() {
+		return
+	}
+	printTaskLine(id, colorCode, status)
+}
+
+func printTaskLine(id, colorCode, line string) {
+	if isJson() {
+		printEvent(TaskLogEvent, map[string]any{"id": id, "line": line})
+		return
+	}
+	if NoColor {
+		fmt.Printf("%s: %s\n", id, line)
+		return
+	}
+	fmt.Printf("%s%s:%s %s\n", colorCode, id, Reset, line)
+}
+
+// Prints the output of a running task line by line, prefixed with the task ID.
+// Incomplete lines are buffered until they're terminated or the writer is flushed.
+type TaskWriter struct {
+	id        string
+	colorCode string
+	buf       []byte
+}
+
+func NewTaskWriter(id string) *TaskWriter {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return &TaskWriter{
+		id:        id,
+		colorCode: nextColorCode(),
+		buf:       []byte{},
+	}
+}
+
+// Prints the status of the task immediately.
+func (tw *TaskWriter) Status(status string) {
+	mutex.Lock()
+	printTaskStatus(tw.id, tw.colorCode, status)
+	mutex.Unlock()
+}
 
-	lines := strings.Split(out, "\n")
-	for _, line := range lines {
-		if NoColor {
-			fmt.Printf("%s: %s\n", id, line)
-			continue
+func (tw *TaskWriter) Write(b []byte) (int, error) {
+	tw.buf = append(tw.buf, b...)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for {
+		i := bytes.IndexByte(tw.buf, '\n')
+		if i < 0 {
+			break
 		}
-		fmt.Printf("%s%s:%s %s\n", colorCode, id, Reset, line)
+		printTaskLine(tw.id, tw.colorCode, strings.TrimSuffix(string(tw.buf[:i]), "\r"))
+		tw.buf = tw.buf[i+1:]
+	}
+
+	return len(b), nil
+}
+
+// Prints any remaining output that wasn't terminated by a newline.
+func (tw *TaskWriter) Flush() {
+	if len(tw.buf) == 0 {
+		return
 	}
 
+	mutex.Lock()
+	printTaskLine(tw.id, tw.colorCode, string(tw.buf))
+	tw.buf = tw.buf[:0]
 	mutex.Unlock()
 }
 
-func Metrics(hits, total, failed int, duration time.Duration) {
+// Prints the IDs of failed tasks along with the last lines of their logs.
+func Failures(logs map[string]string) {
+	// Failed tasks are reported by their task.finished events
+	if isJson() {
+		return
+	}
+
+	ids := make([]string, 0, len(logs))
+	for id := range logs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
 	fmt.Print("\n")
 	if NoColor {
-		metricsNoColor(hits, total, failed, duration)
+		fmt.Println("Failed Tasks:")
+	} else {
+		fmt.Printf("%sFailed Tasks:%s\n", Bold, Reset)
+	}
+
+	for _, id := range ids {
+		lines := strings.Split(logs[id], "\n")
+		if len(lines) > failureLines {
+			lines = lines[len(lines)-failureLines:]
+		}
+
+		for _, line := range lines {
+			if NoColor {
+				fmt.Printf("%s: %s\n", id, line)
+				continue
+			}
+			fmt.Printf("%s%s:%s %s\n", Red, id, Reset, line)
+		}
+	}
+}
+
+func Metrics(hits, total, failed, skipped int, duration time.Duration) {
+	if isJson() {
+		writeEvent(RunFinishedEvent, map[string]any{
+			"passed":     total - failed,
+			"failed":     failed,
+			"skipped":    skipped,
+			"total":      total + skipped,
+			"cacheHits":  hits,
+			"durationMs": duration.Milliseconds(),
+		})
+		return
+	}
+
+	fmt.Print("\n")
+	if NoColor {
+		metricsNoColor(hits, total, failed, skipped, duration)
 		return
 	}
-	metricsColor(hits, total, failed, duration)
+	metricsColor(hits, total, failed, skipped, duration)
 }
 
-func metricsNoColor(hits, total, failed int, duration time.Duration) {
-	taskTxt := fmt.Sprintf("%d passed", total)
+// Prints the tasks that would replay from the cache and the tasks that would execute in a dry run.
+func Plan(hits, misses []string, duration time.Duration) {
+	if isJson() {
+		writeEvent(RunPlannedEvent, map[string]any{
+			"hits":       hits,
+			"misses":     misses,
+			"durationMs": duration.Milliseconds(),
+		})
+		return
+	}
+
+	fmt.Print("\n")
+	total := len(hits) + len(misses)
+	if NoColor {
+		fmt.Printf("Tasks:       %d cached, %d to execute, %d total\n", len(hits), len(misses), total)
+		fmt.Printf("Duration:    %s\n", formatDuration(duration))
+		return
+	}
+
+	hitsTxt := fmt.Sprintf("%s%s%d cached%s", Green, Bold, len(hits), Reset)
+	missesTxt := fmt.Sprintf("%s%s%d to execute%s", Yellow, Bold, len(misses), Reset)
+	fmt.Printf("%sTasks:%s       %s, %s, %d total\n", Bold, Reset, hitsTxt, missesTxt, total)
+	fmt.Printf("%sDuration:%s    %s\n", Bold, Reset, formatDuration(duration))
+}
+
+func metricsNoColor(hits, total, failed, skipped int, duration time.Duration) {
+	taskTxt := fmt.Sprintf("%d passed", total-failed)
 	if failed > 0 {
-		taskTxt = fmt.Sprintf("%d failed", failed)
+		taskTxt += fmt.Sprintf(", %d failed", failed)
 	}
-	fmt.Printf("Tasks:       %s, %d total\n", taskTxt, total)
+	if skipped > 0 {
+		taskTxt += fmt.Sprintf(", %d skipped", skipped)
+	}
+	fmt.Printf("Tasks:       %s, %d total\n", taskTxt, total+skipped)
 
 	hitsTxt := fmt.Sprintf("%d hits, %d total", hits, total)
 	if hits == total {
@@ -87,12 +274,15 @@ func metricsNoColor(hits, total, failed int, duration time.Duration) {
 	fmt.Printf("Duration:    %s\n", formatDuration(duration))
 }
 
-func metricsColor(hits, total, failed int, duration time.Duration) {
-	taskTxt := fmt.Sprintf("%s%s%d passed%s", Green, Bold, total, Reset)
+func metricsColor(hits, total, failed, skipped int, duration time.Duration) {
+	taskTxt := fmt.Sprintf("%s%s%d passed%s", Green, Bold, total-failed, Reset)
 	if failed > 0 {
-		taskTxt = fmt.Sprintf("%s%s%d failed%s", Red, Bold, failed, Reset)
+		taskTxt += fmt.Sprintf(", %s%s%d failed%s", Red, Bold, failed, Reset)
+	}
+	if skipped > 0 {
+		taskTxt += fmt.Sprintf(", %s%s%d skipped%s", Yellow, Bold, skipped, Reset)
 	}
-	fmt.Printf("%sTasks:%s       %s, %d total\n", Bold, Reset, taskTxt, total)
+	fmt.Printf("%sTasks:%s       %s, %d total\n", Bold, Reset, taskTxt, total+skipped)
 
 	hitsTxt := fmt.Sprintf("%d hits, %d total", hits, total)
 	if hits == total {
@@ -0,0 +1,160 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+	"github.com/mitchelldw01/omnirepo/internal/graph"
+)
+
+// Writes the results of a run as a JUnit XML report, with one test case per task.
+type JUnitReporter struct {
+	path string
+	// Map from node IDs to their test cases
+	cases map[string]junitTestCase
+	mutex sync.Mutex
+}
+
+func NewJUnitReporter(path string) *JUnitReporter {
+	return &JUnitReporter{
+		path:  path,
+		cases: map[string]junitTestCase{},
+		mutex: sync.Mutex{},
+	}
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name       string           `xml:"name,attr"`
+	Classname  string           `xml:"classname,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties *junitProperties `xml:"properties,omitempty"`
+	Failure    *junitFailure    `xml:"failure,omitempty"`
+	Skipped    *junitSkipped    `xml:"skipped,omitempty"`
+}
+
+type junitProperties struct {
+	Properties []junitProperty `xml:"property"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Logs    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+func (r *JUnitReporter) TaskFinished(node *graph.Node, isClean bool, res cache.TaskResult) {
+	status := "miss"
+	if isClean {
+		status = "hit"
+	}
+
+	tc := junitTestCase{
+		Name:       node.Id,
+		Classname:  node.Dir,
+		Time:       formatSeconds(res.Duration),
+		Properties: &junitProperties{[]junitProperty{{Name: "cache", Value: status}}},
+	}
+	if res.Failed {
+		tc.Failure = &junitFailure{
+			Message: fmt.Sprintf("task exited with code %d", res.ExitCode),
+			Logs:    res.Logs,
+		}
+	}
+
+	r.mutex.Lock()
+	r.cases[node.Id] = tc
+	r.mutex.Unlock()
+}
+
+func (r *JUnitReporter) TaskSkipped(node *graph.Node) {
+	r.mutex.Lock()
+	r.cases[node.Id] = junitTestCase{
+		Name:      node.Id,
+		Classname: node.Dir,
+		Time:      formatSeconds(0),
+		Skipped:   &junitSkipped{Message: "a dependency failed or the run was stopped"},
+	}
+	r.mutex.Unlock()
+}
+
+// Test cases are sorted by ID so that reports of the same run are identical.
+func (r *JUnitReporter) Finalize(duration time.Duration, cacheUpdated bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	suite := junitTestSuite{
+		Name:      "omni",
+		Time:      formatSeconds(duration),
+		Timestamp: time.Now().Add(-duration).UTC().Format(time.RFC3339),
+		Cases:     make([]junitTestCase, 0, len(r.cases)),
+	}
+	for _, tc := range r.cases {
+		suite.Cases = append(suite.Cases, tc)
+		if tc.Failure != nil {
+			suite.Failures++
+		}
+		if tc.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+	suite.Tests = len(suite.Cases)
+	slices.SortFunc(suite.Cases, func(a, b junitTestCase) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return r.write(junitTestSuites{
+		Name:     suite.Name,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	})
+}
+
+func (r *JUnitReporter) write(suites junitTestSuites) error {
+	b, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal junit report: %v", err)
+	}
+
+	b = append([]byte(xml.Header), b...)
+	return writeReport(r.path, append(b, '\n'))
+}
+
+func formatSeconds(duration time.Duration) string {
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
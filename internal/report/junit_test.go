@@ -0,0 +1,79 @@
+package report_test
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+	"github.com/mitchelldw01/omnirepo/internal/graph"
+	"github.com/mitchelldw01/omnirepo/internal/report"
+	"github.com/mitchelldw01/omnirepo/usercfg"
+)
+
+type testSuites struct {
+	Tests    int `xml:"tests,attr"`
+	Failures int `xml:"failures,attr"`
+	Skipped  int `xml:"skipped,attr"`
+	Suites   []struct {
+		Cases []struct {
+			Name       string `xml:"name,attr"`
+			Classname  string `xml:"classname,attr"`
+			Time       string `xml:"time,attr"`
+			Properties []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"value,attr"`
+			} `xml:"properties>property"`
+			Failure *struct {
+				Logs string `xml:",chardata"`
+			} `xml:"failure"`
+		} `xml:"testcase"`
+	} `xml:"testsuite"`
+}
+
+func TestJUnitReporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports", "junit.xml")
+	r := report.NewJUnitReporter(path)
+
+	pl := usercfg.PipelineConfig{}
+	r.TaskFinished(graph.NewNode("test", "foo", pl), false, cache.NewTaskResult("failed", 1, 1500*time.Millisecond))
+	r.TaskFinished(graph.NewNode("build", "foo", pl), true, cache.NewTaskResult("passed", 0, time.Second))
+	r.TaskSkipped(graph.NewNode("test", "bar", pl))
+
+	if err := r.Finalize(3*time.Second, true); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read junit report: %v", err)
+	}
+
+	var suites testSuites
+	if err := xml.Unmarshal(b, &suites); err != nil {
+		t.Fatalf("failed to unmarshal junit report: %v", err)
+	}
+
+	if suites.Tests != 3 || suites.Failures != 1 || suites.Skipped != 1 {
+		t.Fatalf("expected 3 tests, 1 failure and 1 skipped, got %d, %d and %d",
+			suites.Tests, suites.Failures, suites.Skipped)
+	}
+
+	cases := suites.Suites[0].Cases
+	if cases[0].Name != "bar:test" || cases[1].Name != "foo:build" || cases[2].Name != "foo:test" {
+		t.Fatalf("expected test cases to be sorted by ID, got %+v", cases)
+	}
+
+	failed := cases[2]
+	if failed.Classname != "foo" || failed.Time != "1.500" {
+		t.Fatalf("expected classname %q and time %q, got %q and %q", "foo", "1.500", failed.Classname, failed.Time)
+	}
+	if failed.Failure == nil || failed.Failure.Logs != "failed" {
+		t.Fatalf("expected a failure with the task logs, got %+v", failed.Failure)
+	}
+	if prop := cases[1].Properties[0]; prop.Name != "cache" || prop.Value != "hit" {
+		t.Fatalf("expected the cache property to be %q, got %q", "hit", prop.Value)
+	}
+}
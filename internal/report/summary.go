@@ -0,0 +1,171 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+	"github.com/mitchelldw01/omnirepo/internal/graph"
+)
+
+// The directory that run summaries are written to when no path is given.
+var SummaryDir = filepath.Join(".omni", "runs")
+
+// Provides the inputs and outputs of tasks, which are collected while validating the cache.
+type TaskInspector interface {
+	GetFingerprint(node *graph.Node) string
+	GetInputs(node *graph.Node) map[string]string
+	GetOutputs(node *graph.Node) ([]string, error)
+}
+
+// Writes a JSON summary of every task in a run, so that slow runs and cache misses can be inspected afterwards.
+type SummaryReporter struct {
+	path      string
+	inspector TaskInspector
+	// Map from node IDs to the IDs of their dependencies
+	deps map[string]map[string]struct{}
+	// Map from node IDs to nodes that have finished or been skipped
+	nodes map[string]*graph.Node
+	tasks map[string]taskSummary
+	mutex sync.Mutex
+}
+
+type runSummary struct {
+	Start        time.Time              `json:"start"`
+	DurationMs   int64                  `json:"durationMs"`
+	CacheUpdated bool                   `json:"cacheUpdated"`
+	Tasks        map[string]taskSummary `json:"tasks"`
+}
+
+type taskSummary struct {
+	Dependencies []string          `json:"dependencies"`
+	Fingerprint  string            `json:"fingerprint"`
+	Inputs       map[string]string `json:"inputs"`
+	// Either hit, miss, or skipped
+	Cache string `json:"cache"`
+	// Either passed, failed, or skipped
+	Status     string        `json:"status"`
+	ExitCode   int           `json:"exitCode"`
+	DurationMs int64         `json:"durationMs"`
+	Outputs    outputSummary `json:"outputs"`
+}
+
+type outputSummary struct {
+	// Either restored from the cache, uploaded to the cache, or none
+	Status string   `json:"status"`
+	Files  []string `json:"files"`
+}
+
+// An empty path writes the summary to a timestamped file in SummaryDir.
+func NewSummaryReporter(path string, ti TaskInspector, deps map[string]map[string]struct{}) *SummaryReporter {
+	if path == "" {
+		name := time.Now().UTC().Format("2006-01-02T15-04-05.000Z") + ".json"
+		path = filepath.Join(SummaryDir, name)
+	}
+
+	return &SummaryReporter{
+		path:      path,
+		inspector: ti,
+		deps:      deps,
+		nodes:     map[string]*graph.Node{},
+		tasks:     map[string]taskSummary{},
+		mutex:     sync.Mutex{},
+	}
+}
+
+func (r *SummaryReporter) TaskFinished(node *graph.Node, isClean bool, res cache.TaskResult) {
+	summary := r.newTaskSummary(node)
+	summary.Cache = "miss"
+	if isClean {
+		summary.Cache = "hit"
+	}
+	summary.Status = "passed"
+	if res.Failed {
+		summary.Status = "failed"
+	}
+	summary.ExitCode = res.ExitCode
+	summary.DurationMs = res.Duration.Milliseconds()
+
+	r.mutex.Lock()
+	r.nodes[node.Id] = node
+	r.tasks[node.Id] = summary
+	r.mutex.Unlock()
+}
+
+func (r *SummaryReporter) TaskSkipped(node *graph.Node) {
+	summary := r.newTaskSummary(node)
+	summary.Cache = "skipped"
+	summary.Status = "skipped"
+
+	r.mutex.Lock()
+	r.nodes[node.Id] = node
+	r.tasks[node.Id] = summary
+	r.mutex.Unlock()
+}
+
+func (r *SummaryReporter) newTaskSummary(node *graph.Node) taskSummary {
+	deps := make([]string, 0, len(r.deps[node.Id]))
+	for id := range r.deps[node.Id] {
+		deps = append(deps, id)
+	}
+	slices.Sort(deps)
+
+	inputs := r.inspector.GetInputs(node)
+	if inputs == nil {
+		inputs = map[string]string{}
+	}
+
+	return taskSummary{
+		Dependencies: deps,
+		Fingerprint:  r.inspector.GetFingerprint(node),
+		Inputs:       inputs,
+		Outputs:      outputSummary{Status: "none", Files: []string{}},
+	}
+}
+
+// Outputs are collected once every task has finished, so that they include the outputs restored from the cache.
+func (r *SummaryReporter) Finalize(duration time.Duration, cacheUpdated bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for id, summary := range r.tasks {
+		if err := r.collectOutputs(r.nodes[id], &summary, cacheUpdated); err != nil {
+			return err
+		}
+		r.tasks[id] = summary
+	}
+
+	b, err := json.MarshalIndent(runSummary{
+		Start:        time.Now().Add(-duration).UTC(),
+		DurationMs:   duration.Milliseconds(),
+		CacheUpdated: cacheUpdated,
+		Tasks:        r.tasks,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal run summary: %v", err)
+	}
+
+	return writeReport(r.path, append(b, '\n'))
+}
+
+func (r *SummaryReporter) collectOutputs(node *graph.Node, summary *taskSummary, cacheUpdated bool) error {
+	switch {
+	case summary.Cache == "hit":
+		summary.Outputs.Status = "restored"
+	case summary.Cache == "miss" && cacheUpdated:
+		summary.Outputs.Status = "uploaded"
+	default:
+		return nil
+	}
+
+	files, err := r.inspector.GetOutputs(node)
+	if err != nil {
+		return fmt.Errorf("failed to collect outputs of %q: %v", node.Id, err)
+	}
+	summary.Outputs.Files = files
+	return nil
+}
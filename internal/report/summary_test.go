@@ -0,0 +1,123 @@
+package report_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+	"github.com/mitchelldw01/omnirepo/internal/graph"
+	"github.com/mitchelldw01/omnirepo/internal/report"
+	"github.com/mitchelldw01/omnirepo/usercfg"
+)
+
+type inspector struct{}
+
+func (i *inspector) GetFingerprint(node *graph.Node) string {
+	return node.Id + "-fingerprint"
+}
+
+func (i *inspector) GetInputs(node *graph.Node) map[string]string {
+	return map[string]string{filepath.Join(node.Dir, "input.txt"): "hash"}
+}
+
+func (i *inspector) GetOutputs(node *graph.Node) ([]string, error) {
+	return []string{filepath.Join(node.Dir, "output.txt")}, nil
+}
+
+type summary struct {
+	CacheUpdated bool `json:"cacheUpdated"`
+	Tasks        map[string]struct {
+		Dependencies []string          `json:"dependencies"`
+		Fingerprint  string            `json:"fingerprint"`
+		Inputs       map[string]string `json:"inputs"`
+		Cache        string            `json:"cache"`
+		Status       string            `json:"status"`
+		ExitCode     int               `json:"exitCode"`
+		DurationMs   int64             `json:"durationMs"`
+		Outputs      struct {
+			Status string   `json:"status"`
+			Files  []string `json:"files"`
+		} `json:"outputs"`
+	} `json:"tasks"`
+}
+
+func TestSummaryReporter(t *testing.T) {
+	pl := usercfg.PipelineConfig{}
+	build := graph.NewNode("build", "foo", pl)
+	test := graph.NewNode("test", "foo", pl)
+	lint := graph.NewNode("lint", "bar", pl)
+	deps := map[string]map[string]struct{}{
+		build.Id: {},
+		test.Id:  {build.Id: {}},
+		lint.Id:  {test.Id: {}},
+	}
+
+	t.Run("should record every task", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "summary.json")
+		r := report.NewSummaryReporter(path, &inspector{}, deps)
+		r.TaskFinished(build, true, cache.NewTaskResult("", 0, time.Second))
+		r.TaskFinished(test, false, cache.NewTaskResult("", 2, 1500*time.Millisecond))
+		r.TaskSkipped(lint)
+
+		s := finalizeSummary(t, r, path, true)
+		if len(s.Tasks) != 3 {
+			t.Fatalf("expected %d tasks, got %d", 3, len(s.Tasks))
+		}
+
+		res := s.Tasks[test.Id]
+		if !slices.Equal(res.Dependencies, []string{build.Id}) {
+			t.Fatalf("expected dependencies %v, got %v", []string{build.Id}, res.Dependencies)
+		}
+		if res.Fingerprint != test.Id+"-fingerprint" || res.Inputs["foo/input.txt"] != "hash" {
+			t.Fatalf("expected the fingerprint and inputs of %q, got %q and %v", test.Id, res.Fingerprint, res.Inputs)
+		}
+		if res.Cache != "miss" || res.Status != "failed" || res.ExitCode != 2 || res.DurationMs != 1500 {
+			t.Fatalf("expected a failed cache miss with exit code 2, got %+v", res)
+		}
+		if res.Outputs.Status != "uploaded" || !slices.Equal(res.Outputs.Files, []string{"foo/output.txt"}) {
+			t.Fatalf("expected uploaded outputs, got %+v", res.Outputs)
+		}
+
+		if hit := s.Tasks[build.Id]; hit.Cache != "hit" || hit.Outputs.Status != "restored" {
+			t.Fatalf("expected a cache hit with restored outputs, got %+v", hit)
+		}
+		if skipped := s.Tasks[lint.Id]; skipped.Status != "skipped" || skipped.Outputs.Status != "none" {
+			t.Fatalf("expected a skipped task without outputs, got %+v", skipped)
+		}
+	})
+
+	t.Run("should not record uploaded outputs when the cache wasn't updated", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "summary.json")
+		r := report.NewSummaryReporter(path, &inspector{}, deps)
+		r.TaskFinished(build, false, cache.NewTaskResult("", 0, time.Second))
+
+		s := finalizeSummary(t, r, path, false)
+		if s.CacheUpdated {
+			t.Fatalf("expected %v, got %v", false, s.CacheUpdated)
+		}
+		if res := s.Tasks[build.Id]; res.Outputs.Status != "none" || len(res.Outputs.Files) != 0 {
+			t.Fatalf("expected no outputs, got %+v", res.Outputs)
+		}
+	})
+}
+
+func finalizeSummary(t *testing.T, r *report.SummaryReporter, path string, cacheUpdated bool) summary {
+	if err := r.Finalize(3*time.Second, cacheUpdated); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read run summary: %v", err)
+	}
+
+	var s summary
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatalf("failed to unmarshal run summary: %v", err)
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Options for the S3 and DynamoDB clients, which allow S3 and DynamoDB compatible services to be used.
+type ClientOptions struct {
+	Region string
+	// The URL of the service, instead of the AWS endpoint for the region
+	Endpoint string
+	// Addresses buckets by path instead of by subdomain, which most S3 compatible services require
+	ForcePathStyle bool
+	// The profile in the shared config and credentials files
+	Profile string
+	// The ARN of a role to assume with the loaded credentials
+	RoleArn string
+	// Static credentials, which are used instead of the default credential chain when the access key ID is set
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// Sends unsigned requests, e.g. to read public buckets
+	Anonymous bool
+}
+
+func loadConfig(ctx context.Context, workspace string, opts ClientOptions) (aws.Config, error) {
+	loadOpts := []func(*config.LoadOptions) error{}
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(opts.Region))
+	}
+	if opts.Profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(opts.Profile))
+	}
+	if opts.AccessKeyId != "" {
+		provider := credentials.NewStaticCredentialsProvider(opts.AccessKeyId, opts.SecretAccessKey, opts.SessionToken)
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(provider))
+	}
+	if opts.Anonymous {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(aws.AnonymousCredentials{}))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+
+	// STS is always reached at its AWS endpoint, since the endpoint option only applies to the cache
+	if opts.RoleArn != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), opts.RoleArn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "omni-" + workspace
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return cfg, nil
+}
+
+func baseEndpoint(endpoint string) *string {
+	if endpoint == "" {
+		return nil
+	}
+	return aws.String(endpoint)
+}
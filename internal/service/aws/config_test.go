@@ -0,0 +1,75 @@
+package aws_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	omniAws "github.com/mitchelldw01/omnirepo/internal/service/aws"
+)
+
+func TestNewS3Client(t *testing.T) {
+	t.Run("should use the endpoint and path style addressing", func(t *testing.T) {
+		client, err := omniAws.NewS3Client("omnirepo", omniAws.ClientOptions{
+			Region:         "us-east-1",
+			Endpoint:       "http://localhost:9000",
+			ForcePathStyle: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts := client.Options()
+		if opts.BaseEndpoint == nil || *opts.BaseEndpoint != "http://localhost:9000" {
+			t.Fatalf("expected endpoint %q, got %v", "http://localhost:9000", opts.BaseEndpoint)
+		}
+		if !opts.UsePathStyle {
+			t.Fatal("expected path style addressing")
+		}
+	})
+
+	t.Run("should use static credentials", func(t *testing.T) {
+		client, err := omniAws.NewS3Client("omnirepo", omniAws.ClientOptions{
+			Region:          "us-east-1",
+			AccessKeyId:     "access",
+			SecretAccessKey: "secret",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		creds, err := client.Options().Credentials.Retrieve(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.AccessKeyID != "access" || creds.SecretAccessKey != "secret" {
+			t.Fatalf("expected the static credentials, got %q", creds.AccessKeyID)
+		}
+	})
+
+	t.Run("should return an error when the profile does not exist", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+		t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+
+		_, err := omniAws.NewS3Client("omnirepo", omniAws.ClientOptions{Profile: "missing"})
+		if err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestNewDynamoClient(t *testing.T) {
+	client, err := omniAws.NewDynamoClient("omnirepo", omniAws.ClientOptions{
+		Region:   "us-east-1",
+		Endpoint: "http://localhost:8000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := client.Options()
+	if opts.BaseEndpoint == nil || *opts.BaseEndpoint != "http://localhost:8000" {
+		t.Fatalf("expected endpoint %q, got %v", "http://localhost:8000", opts.BaseEndpoint)
+	}
+}
@@ -7,25 +7,23 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/mitchelldw01/omnirepo/internal/trace"
 )
 
-func NewDynamoClient(workspace, region string) (*dynamodb.Client, error) {
+func NewDynamoClient(workspace string, opts ClientOptions) (*dynamodb.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cfg, err := config.LoadDefaultConfig(ctx)
+	cfg, err := loadConfig(ctx, workspace, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+		return nil, err
 	}
 
-	if region != "" {
-		cfg.Region = region
-	}
-
-	return dynamodb.NewFromConfig(cfg), nil
+	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		o.BaseEndpoint = baseEndpoint(opts.Endpoint)
+	}), nil
 }
 
 type AwsLock struct {
@@ -46,8 +44,12 @@ func (l *AwsLock) Lock() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
+	span := l.startSpan("lock")
+	defer span.End()
+
 	input := l.getLockInput()
 	if _, err := l.client.UpdateItem(ctx, &input); err != nil {
+		span.SetError(err.Error())
 		var apiErr *types.ConditionalCheckFailedException
 		if ok := errors.As(err, &apiErr); ok {
 			return fmt.Errorf("lock is already acquired... run 'omni unlock' to cancel")
@@ -59,6 +61,13 @@ func (l *AwsLock) Lock() error {
 	return nil
 }
 
+func (l *AwsLock) startSpan(operation string) *trace.Span {
+	span := trace.Start("dynamodb.UpdateItem")
+	span.SetAttribute("table", l.table)
+	span.SetAttribute("operation", operation)
+	return span
+}
+
 func (l *AwsLock) getLockInput() dynamodb.UpdateItemInput {
 	// Sets the value of `LockAcquired` to `true` for the item with the given `WorkspaceName`.
 	// If the item does not exist, it will be created.
@@ -81,8 +90,12 @@ func (l *AwsLock) Unlock() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
+	span := l.startSpan("unlock")
+	defer span.End()
+
 	input := l.getUnlockInput()
 	if _, err := l.client.UpdateItem(ctx, &input); err != nil {
+		span.SetError(err.Error())
 		return fmt.Errorf("failed to release cache lock: %v", err)
 	}
 
@@ -9,24 +9,30 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mitchelldw01/omnirepo/internal/trace"
 )
 
-func NewS3Client(workspace, region string) (*s3.Client, error) {
+func startSpan(name, bucket, key string) *trace.Span {
+	span := trace.Start(name)
+	span.SetAttribute("bucket", bucket)
+	span.SetAttribute("key", key)
+	return span
+}
+
+func NewS3Client(workspace string, opts ClientOptions) (*s3.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cfg, err := config.LoadDefaultConfig(ctx)
+	cfg, err := loadConfig(ctx, workspace, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %v", err)
-	}
-
-	if region != "" {
-		cfg.Region = region
+		return nil, err
 	}
 
-	return s3.NewFromConfig(cfg), nil
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = baseEndpoint(opts.Endpoint)
+		o.UsePathStyle = opts.ForcePathStyle
+	}), nil
 }
 
 type AwsTransport struct {
@@ -47,11 +53,15 @@ func (t *AwsTransport) Reader(key string) (io.ReadCloser, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
+	span := startSpan("s3.GetObject", t.bucket, path.Join(t.workspace, key))
+	defer span.End()
+
 	res, err := t.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(t.bucket),
 		Key:    aws.String(path.Join(t.workspace, key)),
 	})
 	if err != nil {
+		span.SetError(err.Error())
 		return nil, err
 	}
 
@@ -96,12 +106,16 @@ func (u *AwsUploader) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
+	span := startSpan("s3.PutObject", u.bucket, u.key)
+	defer span.End()
+
 	_, err := u.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(u.bucket),
 		Key:    aws.String(u.key),
 		Body:   u.file,
 	})
 	if err != nil {
+		span.SetError(err.Error())
 		return fmt.Errorf("failed to write cache artifact: %v", err)
 	}
 
@@ -0,0 +1,173 @@
+package reapi
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Uploads every regular file in an output archive as its own blob, so that other clients of the cache
+// can download the output files of a task without unpacking the archive.
+func (t *ReapiTransport) uploadOutputFiles(key string, archive io.Reader) ([]*repb.OutputFile, error) {
+	decoder, err := zstd.NewReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %v", err)
+	}
+	defer decoder.Close()
+
+	files := []*repb.OutputFile{}
+	r := tar.NewReader(decoder)
+	for {
+		header, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar entry: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		digest, err := t.uploadOutputFile(key, r)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &repb.OutputFile{
+			Path:         header.Name,
+			Digest:       digest,
+			IsExecutable: header.Mode&0o111 != 0,
+		})
+	}
+}
+
+// The file is buffered in a temporary file, since its digest has to be known before it's uploaded.
+func (t *ReapiTransport) uploadOutputFile(key string, r io.Reader) (*repb.Digest, error) {
+	tmp, err := os.CreateTemp("", "reapi-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return t.uploadFile(key, tmp)
+}
+
+// Rebuilds the output archive of a task from its output files. Blobs that were evicted from the CAS
+// are found before any of them is read, so an incomplete archive counts as a missing artifact.
+func (t *ReapiTransport) readOutputArchive(key string, files []*repb.OutputFile) (io.ReadCloser, error) {
+	digests := make([]*repb.Digest, 0, len(files))
+	for _, file := range files {
+		digests = append(digests, file.GetDigest())
+	}
+
+	missing, err := t.findMissingBlobs(key, digests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache artifact %q: %v", key, err)
+	}
+	if missing {
+		return nil, fmt.Errorf("failed to read cache artifact %q: %w", key, os.ErrNotExist)
+	}
+
+	return &archiveReader{transport: t, key: key, files: files}, nil
+}
+
+// Streams an output archive as it's built. Nothing is downloaded until the archive is read,
+// so opening an archive only to tell that it exists is cheap.
+type archiveReader struct {
+	transport *ReapiTransport
+	key       string
+	files     []*repb.OutputFile
+	pipe      *io.PipeReader
+}
+
+func (r *archiveReader) Read(b []byte) (int, error) {
+	if r.pipe == nil {
+		pr, pw := io.Pipe()
+		r.pipe = pr
+		go func() {
+			pw.CloseWithError(r.transport.writeOutputArchive(r.key, r.files, pw))
+		}()
+	}
+	return r.pipe.Read(b)
+}
+
+// Closing the pipe makes the archive fail to be written, which ends the download.
+func (r *archiveReader) Close() error {
+	if r.pipe != nil {
+		return r.pipe.Close()
+	}
+	return nil
+}
+
+func (t *ReapiTransport) writeOutputArchive(key string, files []*repb.OutputFile, dst io.Writer) error {
+	w, err := zstd.NewWriter(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd writer: %v", err)
+	}
+	tw := tar.NewWriter(w)
+
+	// Archives are unpacked without creating parent directories, so every directory gets its own entry
+	dirs := map[string]bool{".": true}
+	for _, file := range files {
+		if err := writeParentDirs(tw, dirs, path.Dir(file.GetPath())); err != nil {
+			return err
+		}
+		if err := t.writeOutputFile(key, file, tw); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func writeParentDirs(tw *tar.Writer, dirs map[string]bool, dir string) error {
+	if dirs[dir] {
+		return nil
+	}
+	if err := writeParentDirs(tw, dirs, path.Dir(dir)); err != nil {
+		return err
+	}
+
+	dirs[dir] = true
+	return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0o755})
+}
+
+func (t *ReapiTransport) writeOutputFile(key string, file *repb.OutputFile, tw *tar.Writer) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     file.GetPath(),
+		Size:     file.GetDigest().GetSizeBytes(),
+		Mode:     0o644,
+	}
+	if file.GetIsExecutable() {
+		header.Mode = 0o755
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	br, err := t.readBlob(key, file.GetDigest())
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+
+	_, err = io.Copy(tw, br)
+	return err
+}
@@ -0,0 +1,248 @@
+package reapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The size of the chunks that blobs are uploaded in, which stays well below the default gRPC message limit.
+const chunkSize = 1 << 20
+
+var errStreamIdle = fmt.Errorf("no data was transferred for %v", rpcTimeout)
+
+// The context of a stream, which is cancelled when the stream goes without progress for too long.
+// Streams can take any amount of time as long as they make progress, so they don't have a deadline.
+type streamContext struct {
+	context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+}
+
+func newStreamContext() *streamContext {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	timer := time.AfterFunc(rpcTimeout, func() { cancel(errStreamIdle) })
+	return &streamContext{Context: ctx, cancel: cancel, timer: timer}
+}
+
+// Restarts the idle timeout, after the stream made progress.
+func (c *streamContext) progress() {
+	c.timer.Reset(rpcTimeout)
+}
+
+func (c *streamContext) close() {
+	c.timer.Stop()
+	c.cancel(context.Canceled)
+}
+
+// Reports an idle stream as such, rather than as a cancelled call.
+func (c *streamContext) wrap(err error) error {
+	if errors.Is(context.Cause(c), errStreamIdle) {
+		return errStreamIdle
+	}
+	return err
+}
+
+func (t *ReapiTransport) readResourceName(digest *repb.Digest) string {
+	return path.Join(t.instance, "blobs", digest.GetHash(), fmt.Sprint(digest.GetSizeBytes()))
+}
+
+func (t *ReapiTransport) writeResourceName(digest *repb.Digest) (string, error) {
+	uuid, err := newUuid()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(t.instance, "uploads", uuid, "blobs", digest.GetHash(), fmt.Sprint(digest.GetSizeBytes())), nil
+}
+
+// A blob that was evicted from the CAS is as good as a missing artifact. The server only reports it
+// once the stream is read, so the first chunk is received here, before callers see any error.
+func (t *ReapiTransport) readBlob(key string, digest *repb.Digest) (*blobReader, error) {
+	ctx := newStreamContext()
+	stream, err := t.byteStream.Read(ctx, &bspb.ReadRequest{ResourceName: t.readResourceName(digest)})
+	if err != nil {
+		ctx.close()
+		return nil, fmt.Errorf("failed to read cache artifact %q: %v", key, err)
+	}
+
+	r := &blobReader{stream: stream, ctx: ctx, key: key}
+	if err := r.receive(); err != nil && !errors.Is(err, io.EOF) {
+		ctx.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reads a blob from a ByteStream as it's received.
+type blobReader struct {
+	stream bspb.ByteStream_ReadClient
+	ctx    *streamContext
+	key    string
+	buf    []byte
+	// The error that ended the stream, e.g. io.EOF
+	err error
+}
+
+func (r *blobReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if err := r.receive(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Receives the next chunk of the blob. The stream isn't received from again once it has ended.
+func (r *blobReader) receive() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	res, err := r.stream.Recv()
+	switch {
+	case errors.Is(err, io.EOF):
+		r.err = io.EOF
+	case status.Code(err) == codes.NotFound:
+		r.err = fmt.Errorf("failed to read cache artifact %q: %w", r.key, os.ErrNotExist)
+	case err != nil:
+		r.err = fmt.Errorf("failed to read cache artifact %q: %v", r.key, r.ctx.wrap(err))
+	default:
+		r.ctx.progress()
+		r.buf = res.GetData()
+	}
+	return r.err
+}
+
+func (r *blobReader) Close() error {
+	r.ctx.close()
+	return nil
+}
+
+// Reports whether any of the blobs are missing from the CAS, e.g. because they were evicted.
+func (t *ReapiTransport) findMissingBlobs(key string, digests []*repb.Digest) (bool, error) {
+	if len(digests) == 0 {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	span := startSpan("reapi.FindMissingBlobs", t.instance, key)
+	defer span.End()
+	res, err := t.cas.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		InstanceName: t.instance,
+		BlobDigests:  digests,
+	})
+	if err != nil {
+		span.SetError(err.Error())
+		return false, err
+	}
+	return len(res.GetMissingBlobDigests()) > 0, nil
+}
+
+// Uploads the rest of the file as a blob, and returns its digest.
+func (t *ReapiTransport) uploadFile(key string, file *os.File) (*repb.Digest, error) {
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	digest := &repb.Digest{Hash: hex.EncodeToString(hash.Sum(nil)), SizeBytes: size}
+	if err := t.uploadBlob(key, digest, file); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+func (t *ReapiTransport) uploadBlob(key string, digest *repb.Digest, r io.Reader) error {
+	span := startSpan("reapi.Write", t.instance, key)
+	defer span.End()
+
+	name, err := t.writeResourceName(digest)
+	if err != nil {
+		return err
+	}
+
+	ctx := newStreamContext()
+	defer ctx.close()
+	stream, err := t.byteStream.Write(ctx)
+	if err != nil {
+		span.SetError(err.Error())
+		return err
+	}
+
+	buf := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		finished := offset+int64(n) == digest.GetSizeBytes()
+		if n == 0 && !finished {
+			return fmt.Errorf("blob ended after %d of %d bytes", offset, digest.GetSizeBytes())
+		}
+
+		req := &bspb.WriteRequest{WriteOffset: offset, Data: buf[:n], FinishWrite: finished}
+		// The resource name only has to be sent with the first request
+		if offset == 0 {
+			req.ResourceName = name
+		}
+		// The server closes the stream early when it already has the blob
+		if err := stream.Send(req); err != nil && !errors.Is(err, io.EOF) {
+			err = ctx.wrap(err)
+			span.SetError(err.Error())
+			return err
+		}
+		ctx.progress()
+		offset += int64(n)
+		if finished {
+			break
+		}
+	}
+
+	if _, err := stream.CloseAndRecv(); err != nil {
+		err = ctx.wrap(err)
+		span.SetError(err.Error())
+		return err
+	}
+	return nil
+}
+
+func digestOf(b []byte) *repb.Digest {
+	hash := sha256.Sum256(b)
+	return &repb.Digest{Hash: hex.EncodeToString(hash[:]), SizeBytes: int64(len(b))}
+}
+
+func newUuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate upload ID: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,325 @@
+package reapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/mitchelldw01/omnirepo/internal/trace"
+)
+
+// The timeout of calls that return a single response, and how long a stream may go without progress.
+const rpcTimeout = 60 * time.Second
+
+func startSpan(name, instance, key string) *trace.Span {
+	span := trace.Start(name)
+	span.SetAttribute("instance", instance)
+	span.SetAttribute("key", key)
+	return span
+}
+
+// Connects to a cache that implements the Remote Execution API.
+// The target has a "grpc://" scheme for plaintext connections, or a "grpcs://" scheme for TLS.
+// When a token is given, it's sent as a bearer token with every call.
+func NewReapiClient(target, token string) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{}
+	if addr, ok := strings.CutPrefix(target, "grpcs://"); ok {
+		target = addr
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
+	} else if addr, ok := strings.CutPrefix(target, "grpc://"); ok {
+		target = addr
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		return nil, fmt.Errorf("invalid remote cache url %q, expected a grpc:// or grpcs:// scheme", target)
+	}
+
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken(token)))
+	}
+
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to remote cache: %v", err)
+	}
+	return conn, nil
+}
+
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(_ context.Context, _ ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// The token is sent over plaintext connections too, since those are chosen explicitly with grpc://.
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// The kinds of artifacts that are stored in a Remote Execution API cache.
+const (
+	entryArtifact = iota
+	archiveArtifact
+)
+
+// Stores the results of tasks in the Action Cache and CAS of a Remote Execution API cache.
+// Every fingerprint maps to an Action Cache entry, whose action digest is the fingerprint itself.
+// The action result has the exit code of the task, its logs as stdout, and every output file as its own CAS blob.
+// The cache entry is stored as a CAS blob too, and is referenced from the auxiliary metadata of the result.
+//
+// Cache entries and output archives are written separately, so the output files of an archive are kept
+// until the cache entry with the same fingerprint is written. The cache indexes aren't stored by fingerprint,
+// so they can't be stored in the Action Cache.
+type ReapiTransport struct {
+	actionCache repb.ActionCacheClient
+	cas         repb.ContentAddressableStorageClient
+	byteStream  bspb.ByteStreamClient
+	instance    string
+	// Output files of archives that were uploaded, mapped by fingerprint until the cache entry is written
+	outputs map[string][]*repb.OutputFile
+	mutex   sync.Mutex
+}
+
+func NewReapiTransport(conn *grpc.ClientConn, instance string) *ReapiTransport {
+	return &ReapiTransport{
+		actionCache: repb.NewActionCacheClient(conn),
+		cas:         repb.NewContentAddressableStorageClient(conn),
+		byteStream:  bspb.NewByteStreamClient(conn),
+		instance:    instance,
+		outputs:     map[string][]*repb.OutputFile{},
+	}
+}
+
+func (t *ReapiTransport) Reader(key string) (io.ReadCloser, error) {
+	fingerprint, kind, err := parseKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.getActionResult(key, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if kind == archiveArtifact {
+		return t.readOutputArchive(key, res.GetOutputFiles())
+	}
+
+	digest, err := entryDigest(res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache artifact %q: %w", key, err)
+	}
+	return t.readBlob(key, digest)
+}
+
+func (t *ReapiTransport) Writer(key string) (io.WriteCloser, error) {
+	fingerprint, kind, err := parseKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "reapi-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write cache artifact: %v", err)
+	}
+
+	return &ReapiUploader{
+		transport:   t,
+		file:        tmp,
+		key:         key,
+		fingerprint: fingerprint,
+		kind:        kind,
+	}, nil
+}
+
+// Only cache entries and output archives are stored by fingerprint.
+func parseKey(key string) (string, int, error) {
+	if fingerprint, ok := cutAffixes(key, "tasks/", ".json"); ok {
+		return fingerprint, entryArtifact, nil
+	}
+	if fingerprint, ok := cutAffixes(key, "outputs/", ".tar.zst"); ok {
+		return fingerprint, archiveArtifact, nil
+	}
+	return "", 0, fmt.Errorf("failed to access cache artifact %q: only cache entries and output archives are stored", key)
+}
+
+func cutAffixes(s, prefix, suffix string) (string, bool) {
+	s, ok := strings.CutPrefix(s, prefix)
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(s, suffix)
+}
+
+// The fingerprint is the SHA-256 hash of the task key, like an action digest is the hash of an action.
+// The key isn't stored alongside it, so the size is left out.
+func actionDigest(fingerprint string) *repb.Digest {
+	return &repb.Digest{Hash: fingerprint}
+}
+
+func (t *ReapiTransport) getActionResult(key, fingerprint string) (*repb.ActionResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	span := startSpan("reapi.GetActionResult", t.instance, key)
+	defer span.End()
+	res, err := t.actionCache.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName:      t.instance,
+		ActionDigest:      actionDigest(fingerprint),
+		InlineStdout:      false,
+		InlineOutputFiles: []string{},
+	})
+	if err != nil {
+		span.SetError(err.Error())
+		if status.Code(err) == codes.NotFound {
+			return nil, fmt.Errorf("failed to read cache artifact %q: %w", key, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to read cache artifact %q: %v", key, err)
+	}
+	return res, nil
+}
+
+// Action results that weren't written by omni, e.g. by Bazel, have no cache entry, so they count as misses.
+func entryDigest(res *repb.ActionResult) (*repb.Digest, error) {
+	for _, meta := range res.GetExecutionMetadata().GetAuxiliaryMetadata() {
+		digest := &repb.Digest{}
+		if meta.MessageIs(digest) {
+			if err := meta.UnmarshalTo(digest); err != nil {
+				return nil, err
+			}
+			return digest, nil
+		}
+	}
+	return nil, fmt.Errorf("action result has no cache entry: %w", os.ErrNotExist)
+}
+
+// Reads the exit code and logs of a task from its cache entry. The cache entry is written by the cache package,
+// which marshals the result of the task without JSON tags.
+func parseEntryResult(r io.Reader) (int, []byte, error) {
+	var entry struct {
+		Result struct {
+			Logs     string
+			ExitCode int
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(r).Decode(&entry); err != nil {
+		return 0, nil, err
+	}
+	return entry.Result.ExitCode, []byte(entry.Result.Logs), nil
+}
+
+// Buffers an artifact in a temporary file, and uploads it when it's closed.
+// The output files of an archive are uploaded as separate blobs, and the action result is only updated
+// once the cache entry is written, so the action result never refers to a missing blob.
+type ReapiUploader struct {
+	transport   *ReapiTransport
+	file        *os.File
+	key         string
+	fingerprint string
+	kind        int
+}
+
+func (u *ReapiUploader) Write(b []byte) (int, error) {
+	n, err := u.file.Write(b)
+	if err != nil {
+		return n, fmt.Errorf("failed to write cache artifact: %v", err)
+	}
+	return n, nil
+}
+
+func (u *ReapiUploader) Close() error {
+	defer os.Remove(u.file.Name())
+	defer u.file.Close()
+
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to write cache artifact: %v", err)
+	}
+
+	var err error
+	if u.kind == archiveArtifact {
+		err = u.uploadOutputArchive()
+	} else {
+		err = u.updateActionResult()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write cache artifact %q: %v", u.key, err)
+	}
+	return nil
+}
+
+func (u *ReapiUploader) uploadOutputArchive() error {
+	files, err := u.transport.uploadOutputFiles(u.key, u.file)
+	if err != nil {
+		return err
+	}
+
+	u.transport.mutex.Lock()
+	u.transport.outputs[u.fingerprint] = files
+	u.transport.mutex.Unlock()
+	return nil
+}
+
+func (u *ReapiUploader) updateActionResult() error {
+	t := u.transport
+	entry, err := t.uploadFile(u.key, u.file)
+	if err != nil {
+		return err
+	}
+
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	exitCode, logs, err := parseEntryResult(u.file)
+	if err != nil {
+		return fmt.Errorf("failed to parse cache entry: %v", err)
+	}
+	stdout := digestOf(logs)
+	if err := t.uploadBlob(u.key, stdout, bytes.NewReader(logs)); err != nil {
+		return err
+	}
+
+	meta, err := anypb.New(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache entry digest: %v", err)
+	}
+
+	t.mutex.Lock()
+	outputs := t.outputs[u.fingerprint]
+	delete(t.outputs, u.fingerprint)
+	t.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	span := startSpan("reapi.UpdateActionResult", t.instance, u.key)
+	defer span.End()
+	_, err = t.actionCache.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName: t.instance,
+		ActionDigest: actionDigest(u.fingerprint),
+		ActionResult: &repb.ActionResult{
+			OutputFiles:       outputs,
+			ExitCode:          int32(exitCode),
+			StdoutDigest:      stdout,
+			ExecutionMetadata: &repb.ExecutedActionMetadata{AuxiliaryMetadata: []*anypb.Any{meta}},
+		},
+	})
+	if err != nil {
+		span.SetError(err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,557 @@
+package reapi_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/klauspost/compress/zstd"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+	"github.com/mitchelldw01/omnirepo/internal/graph"
+	"github.com/mitchelldw01/omnirepo/internal/service/reapi"
+	"github.com/mitchelldw01/omnirepo/usercfg"
+)
+
+const (
+	body     = "lorem ipsum dolor sit amet"
+	instance = "main"
+)
+
+var (
+	fingerprint = fmt.Sprintf("%x", sha256.Sum256([]byte("test")))
+	entryKey    = "tasks/" + fingerprint + ".json"
+	archiveKey  = "outputs/" + fingerprint + ".tar.zst"
+	entry       = fmt.Sprintf(`{"result":{"Logs":%q,"Failed":true,"ExitCode":2,"Duration":1000}}`, body)
+)
+
+// Implements the Action Cache, and the ByteStream API and blob lookups of a CAS in memory.
+type casServer struct {
+	repb.UnimplementedActionCacheServer
+	repb.UnimplementedContentAddressableStorageServer
+	bspb.UnimplementedByteStreamServer
+	results map[string]*repb.ActionResult
+	// Blobs mapped by resource name, without the upload ID
+	blobs map[string][]byte
+	// The resource name of the last upload
+	upload string
+	mutex  sync.Mutex
+}
+
+func newCasServer(t *testing.T) (*grpc.ClientConn, *casServer) {
+	s := &casServer{results: map[string]*repb.ActionResult{}, blobs: map[string][]byte{}}
+	server := grpc.NewServer()
+	repb.RegisterActionCacheServer(server, s)
+	repb.RegisterContentAddressableStorageServer(server, s)
+	bspb.RegisterByteStreamServer(server, s)
+
+	lis := bufconn.Listen(1 << 20)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, s
+}
+
+func blobName(digest *repb.Digest) string {
+	return path.Join(instance, "blobs", digest.GetHash(), fmt.Sprint(digest.GetSizeBytes()))
+}
+
+func (s *casServer) GetActionResult(_ context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res, ok := s.results[req.GetInstanceName()+"/"+req.GetActionDigest().GetHash()]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "action result not found")
+	}
+	return res, nil
+}
+
+func (s *casServer) UpdateActionResult(_ context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.results[req.GetInstanceName()+"/"+req.GetActionDigest().GetHash()] = req.GetActionResult()
+	return req.GetActionResult(), nil
+}
+
+func (s *casServer) FindMissingBlobs(_ context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res := &repb.FindMissingBlobsResponse{}
+	for _, digest := range req.GetBlobDigests() {
+		if _, ok := s.blobs[blobName(digest)]; !ok {
+			res.MissingBlobDigests = append(res.MissingBlobDigests, digest)
+		}
+	}
+	return res, nil
+}
+
+func (s *casServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	s.mutex.Lock()
+	b, ok := s.blobs[req.GetResourceName()]
+	s.mutex.Unlock()
+	if !ok {
+		return status.Error(codes.NotFound, "blob not found")
+	}
+
+	// Sends the blob in several chunks
+	for len(b) > 0 {
+		n := min(len(b), 8)
+		if err := stream.Send(&bspb.ReadResponse{Data: b[:n]}); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func (s *casServer) Write(stream bspb.ByteStream_WriteServer) error {
+	var name string
+	var buf bytes.Buffer
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if req.GetResourceName() != "" {
+			name = req.GetResourceName()
+		}
+		if req.GetWriteOffset() != int64(buf.Len()) {
+			return status.Error(codes.InvalidArgument, "unexpected write offset")
+		}
+		buf.Write(req.GetData())
+		if req.GetFinishWrite() {
+			break
+		}
+	}
+
+	// Strips the upload ID, so that the blob is stored under its read resource name
+	parts := strings.Split(name, "/")
+	if len(parts) != 6 || parts[1] != "uploads" {
+		return status.Errorf(codes.InvalidArgument, "invalid resource name %q", name)
+	}
+
+	s.mutex.Lock()
+	s.upload = name
+	s.blobs[strings.Join([]string{parts[0], parts[3], parts[4], parts[5]}, "/")] = buf.Bytes()
+	s.mutex.Unlock()
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: int64(buf.Len())})
+}
+
+// The cache entry is found through the auxiliary metadata of the action result.
+func (s *casServer) entryDigest(t *testing.T) *repb.Digest {
+	res, ok := s.results[instance+"/"+fingerprint]
+	if !ok {
+		t.Fatal("expected an action result for the fingerprint")
+	}
+	digest := &repb.Digest{}
+	if err := res.GetExecutionMetadata().GetAuxiliaryMetadata()[0].UnmarshalTo(digest); err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestReader(t *testing.T) {
+	t.Run("should read a cache entry that was written", func(t *testing.T) {
+		conn, _ := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+		if err := writeArtifact(trans, entryKey, entry); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := readArtifact(trans, entryKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != entry {
+			t.Fatalf("expected %q, got %q", entry, res)
+		}
+	})
+
+	t.Run("should return a not exist error when the artifact does not exist", func(t *testing.T) {
+		conn, _ := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+
+		for _, key := range []string{entryKey, archiveKey} {
+			if _, err := trans.Reader(key); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected a not exist error for %q, got %v", key, err)
+			}
+		}
+	})
+
+	t.Run("should return a not exist error when the blob of the cache entry was evicted", func(t *testing.T) {
+		conn, s := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+		if err := writeArtifact(trans, entryKey, entry); err != nil {
+			t.Fatal(err)
+		}
+		delete(s.blobs, blobName(s.entryDigest(t)))
+
+		if _, err := trans.Reader(entryKey); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected a not exist error, got %v", err)
+		}
+	})
+
+	t.Run("should return a not exist error when the action result has no cache entry", func(t *testing.T) {
+		conn, s := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+		s.results[instance+"/"+fingerprint] = &repb.ActionResult{ExitCode: 0}
+
+		if _, err := trans.Reader(entryKey); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected a not exist error, got %v", err)
+		}
+	})
+
+	t.Run("should return an error for artifacts that are not stored by fingerprint", func(t *testing.T) {
+		conn, _ := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+
+		if _, err := trans.Reader("fingerprints.json"); err == nil || errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected an error, got %v", err)
+		}
+		if _, err := trans.Writer("fingerprints.json"); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+
+	t.Run("should rebuild the output archive from the output files", func(t *testing.T) {
+		conn, _ := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+		files := map[string]string{"dist/index.js": body, "dist/bin/run.sh": "#!/bin/sh", "README.md": ""}
+		if err := writeOutputs(trans, files); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := trans.Reader(archiveKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		headers, contents, err := readArchive(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, content := range files {
+			if contents[name] != content {
+				t.Fatalf("expected %q to contain %q, got %q", name, content, contents[name])
+			}
+		}
+		if headers["dist/bin/run.sh"].Mode&0o111 == 0 {
+			t.Fatal("expected run.sh to be executable")
+		}
+		// Parent directories come before the files in them, since archives are unpacked in order
+		for _, dir := range []string{"dist/", "dist/bin/"} {
+			if _, ok := headers[dir]; !ok {
+				t.Fatalf("expected a directory entry for %q", dir)
+			}
+		}
+	})
+
+	t.Run("should return a not exist error when an output file was evicted", func(t *testing.T) {
+		conn, s := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+		if err := writeOutputs(trans, map[string]string{"dist/index.js": body}); err != nil {
+			t.Fatal(err)
+		}
+		delete(s.blobs, blobName(s.results[instance+"/"+fingerprint].GetOutputFiles()[0].GetDigest()))
+
+		if _, err := trans.Reader(archiveKey); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected a not exist error, got %v", err)
+		}
+	})
+}
+
+func TestValidateWithEvictedBlobs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get current directory: %v", err)
+	}
+
+	configs := map[string]usercfg.TargetConfig{
+		"foo": {
+			Pipeline: map[string]usercfg.PipelineConfig{
+				"build": {Includes: []string{"input.txt"}, Outputs: []string{"output.txt"}},
+			},
+		},
+	}
+	node := graph.NewNode("build", "foo", configs["foo"].Pipeline["build"])
+
+	testCases := []struct {
+		name string
+		// The digest of the blob that is evicted, given the action result of the node
+		evicted func(res *repb.ActionResult) *repb.Digest
+	}{
+		{
+			name: "should miss when the blob of the cache entry was evicted",
+			evicted: func(res *repb.ActionResult) *repb.Digest {
+				digest := &repb.Digest{}
+				res.GetExecutionMetadata().GetAuxiliaryMetadata()[0].UnmarshalTo(digest)
+				return digest
+			},
+		},
+		{
+			name: "should miss when the blob of an output file was evicted",
+			evicted: func(res *repb.ActionResult) *repb.Digest {
+				return res.GetOutputFiles()[0].GetDigest()
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if err := os.Chdir(wd); err != nil {
+					t.Logf("failed to reset working directory: %v", err)
+				}
+			}()
+
+			dir := t.TempDir()
+			if err := os.Chdir(dir); err != nil {
+				t.Fatalf("failed to change directory: %v", err)
+			}
+			if err := os.MkdirAll("foo", 0o755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"input.txt", "output.txt"} {
+				if err := os.WriteFile(filepath.Join("foo", name), []byte(body), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			conn, s := newCasServer(t)
+			trans := cache.NewImmutableTransport(reapi.NewReapiTransport(conn, instance))
+
+			cr := cache.NewCacheReader(trans, configs, []string{"foo"}, true)
+			if _, err := cr.Validate(node, map[string]struct{}{}); err != nil {
+				t.Fatal(err)
+			}
+			cw := cache.NewCacheWriter(trans, cr)
+			defer cw.Cleanup()
+			if err := cw.WriteTaskResult(node.Dir, node.Name, cache.NewTaskResult("logs", 0, time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if err := cw.Update(); err != nil {
+				t.Fatal(err)
+			}
+
+			res, ok := s.results[instance+"/"+cr.GetFingerprint(node)]
+			if !ok {
+				t.Fatal("expected an action result keyed by the fingerprint")
+			}
+			delete(s.blobs, blobName(tc.evicted(res)))
+
+			cr = cache.NewCacheReader(trans, configs, []string{"foo"}, false)
+			defer cr.Cleanup()
+			valid, err := cr.Validate(node, map[string]struct{}{})
+			if err != nil {
+				t.Fatalf("expected a cache miss, got error: %v", err)
+			}
+			if valid {
+				t.Fatal("expected a cache miss, got a hit")
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	t.Run("should store the exit code and logs of the task in the action result", func(t *testing.T) {
+		conn, s := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+		if err := writeArtifact(trans, entryKey, entry); err != nil {
+			t.Fatal(err)
+		}
+
+		res, ok := s.results[instance+"/"+fingerprint]
+		if !ok {
+			t.Fatal("expected an action result keyed by the fingerprint")
+		}
+		if res.GetExitCode() != 2 {
+			t.Fatalf("expected exit code 2, got %d", res.GetExitCode())
+		}
+		if logs := string(s.blobs[blobName(res.GetStdoutDigest())]); logs != body {
+			t.Fatalf("expected stdout %q, got %q", body, logs)
+		}
+		if !strings.HasPrefix(s.upload, instance+"/uploads/") {
+			t.Fatalf("expected the upload to be scoped to the instance, got %q", s.upload)
+		}
+	})
+
+	t.Run("should store every output file as its own blob", func(t *testing.T) {
+		conn, s := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+		files := map[string]string{"dist/index.js": body, "dist/bin/run.sh": "#!/bin/sh"}
+		if err := writeOutputs(trans, files); err != nil {
+			t.Fatal(err)
+		}
+
+		outputs := s.results[instance+"/"+fingerprint].GetOutputFiles()
+		if len(outputs) != len(files) {
+			t.Fatalf("expected %d output files, got %d", len(files), len(outputs))
+		}
+		for _, file := range outputs {
+			if content := string(s.blobs[blobName(file.GetDigest())]); content != files[file.GetPath()] {
+				t.Fatalf("expected %q to contain %q, got %q", file.GetPath(), files[file.GetPath()], content)
+			}
+			if file.GetIsExecutable() != (file.GetPath() == "dist/bin/run.sh") {
+				t.Fatalf("unexpected executable bit for %q", file.GetPath())
+			}
+		}
+	})
+
+	t.Run("should upload large artifacts in several chunks", func(t *testing.T) {
+		conn, _ := newCasServer(t)
+		trans := reapi.NewReapiTransport(conn, instance)
+		large := fmt.Sprintf(`{"result":{"Logs":%q}}`, strings.Repeat(body, 100_000))
+		if err := writeArtifact(trans, entryKey, large); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := readArtifact(trans, entryKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != large {
+			t.Fatalf("expected %d bytes, got %d", len(large), len(res))
+		}
+	})
+}
+
+func TestNewReapiClient(t *testing.T) {
+	t.Run("should return an error when the url has no grpc scheme", func(t *testing.T) {
+		if _, err := reapi.NewReapiClient("https://localhost:8980", ""); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func writeArtifact(trans *reapi.ReapiTransport, path, body string) error {
+	w, err := trans.Writer(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func readArtifact(trans *reapi.ReapiTransport, path string) (string, error) {
+	r, err := trans.Reader(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read from reader: %w", err)
+	}
+	return string(b), nil
+}
+
+// Writes an output archive of the files, and then the cache entry, like the cache writer does.
+// Files ending in ".sh" are executable.
+func writeOutputs(trans *reapi.ReapiTransport, files map[string]string) error {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: ".", Mode: 0o755}); err != nil {
+		return err
+	}
+	for name, content := range files {
+		mode := int64(0o644)
+		if strings.HasSuffix(name, ".sh") {
+			mode = 0o755
+		}
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode, Size: int64(len(content))}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if err := writeArtifact(trans, archiveKey, buf.String()); err != nil {
+		return err
+	}
+	return writeArtifact(trans, entryKey, entry)
+}
+
+// Returns the headers of the archive and the contents of its files, mapped by name.
+func readArchive(r io.Reader) (map[string]*tar.Header, map[string]string, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer decoder.Close()
+
+	headers := map[string]*tar.Header{}
+	contents := map[string]string{}
+	tr := tar.NewReader(decoder)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return headers, contents, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			dir := path.Dir(header.Name) + "/"
+			if _, ok := headers[dir]; !ok && dir != "./" {
+				return nil, nil, fmt.Errorf("expected %q to come after its directory", header.Name)
+			}
+		}
+
+		headers[header.Name] = header
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		contents[header.Name] = string(b)
+	}
+}
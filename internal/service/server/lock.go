@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/log"
+	"github.com/mitchelldw01/omnirepo/internal/trace"
+)
+
+// Locks the cache of a workspace on a cache server.
+// The lock is refreshed in the background while it's held, since the server expires locks that aren't refreshed.
+type ServerLock struct {
+	client    *http.Client
+	baseUrl   string
+	token     string
+	workspace string
+	// The ID of the lock while it's held
+	id string
+	// Whether the lock was acquired by this client, as opposed to being removed with 'omni unlock'
+	acquired bool
+	// Closed to stop refreshing the lock
+	stop  chan struct{}
+	mutex sync.Mutex
+}
+
+func NewServerLock(baseUrl, token, workspace string) *ServerLock {
+	return &ServerLock{
+		client:    &http.Client{Timeout: 60 * time.Second},
+		baseUrl:   strings.TrimSuffix(baseUrl, "/"),
+		token:     token,
+		workspace: workspace,
+	}
+}
+
+func (l *ServerLock) Lock() error {
+	res, err := l.do(http.MethodPost, "lock", "")
+	if err != nil {
+		return fmt.Errorf("failed to acquire cache lock: %v", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return fmt.Errorf("lock is already acquired... run 'omni unlock' to cancel")
+	default:
+		return fmt.Errorf("failed to acquire cache lock: unexpected status %d", res.StatusCode)
+	}
+
+	var body lockResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to acquire cache lock: %v", err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.id, l.acquired = body.Id, true
+	l.stop = make(chan struct{})
+	go l.refresh(body.Id, time.Duration(body.Ttl)*time.Millisecond, l.stop)
+	return nil
+}
+
+// Refreshes the lock well within its TTL, so that a single failed request doesn't let it expire.
+func (l *ServerLock) refresh(id string, ttl time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		res, err := l.do(http.MethodPut, "refresh", id)
+		if err != nil {
+			log.Warn("failed to refresh cache lock", "workspace", l.workspace, "error", err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusConflict {
+			log.Warn("cache lock expired and was acquired by another run", "workspace", l.workspace)
+			return
+		}
+		if res.StatusCode != http.StatusNoContent {
+			log.Warn("failed to refresh cache lock", "workspace", l.workspace, "status", res.StatusCode)
+		}
+	}
+}
+
+// A lock that wasn't acquired by this client is removed no matter which run holds it, which is what 'omni unlock' does.
+// Otherwise only the lock with the ID of this client is released, and releasing it again does nothing.
+func (l *ServerLock) Unlock() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.acquired && l.id == "" {
+		return nil
+	}
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+
+	res, err := l.do(http.MethodDelete, "unlock", l.id)
+	if err != nil {
+		return fmt.Errorf("failed to release cache lock: %v", err)
+	}
+	res.Body.Close()
+	l.id = ""
+
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusConflict:
+		return fmt.Errorf("failed to release cache lock: the lock expired and was acquired by another run")
+	default:
+		return fmt.Errorf("failed to release cache lock: unexpected status %d", res.StatusCode)
+	}
+}
+
+// The ID of the lock is part of the URL, except when the lock is acquired or removed forcefully.
+func (l *ServerLock) do(method, operation, id string) (*http.Response, error) {
+	addr := fmt.Sprintf("%s/v8/locks/%s", l.baseUrl, url.PathEscape(l.workspace))
+	if id != "" {
+		addr += "/" + url.PathEscape(id)
+	}
+	span := trace.Start("server.lock")
+	span.SetAttribute("url", addr)
+	span.SetAttribute("operation", operation)
+	defer span.End()
+
+	req, err := http.NewRequest(method, addr, nil)
+	if err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+l.token)
+
+	res, err := l.client.Do(req)
+	if err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	return res, nil
+}
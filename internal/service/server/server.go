@@ -0,0 +1,349 @@
+package server
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/log"
+)
+
+// Temporary files are written with this prefix, so that they're never served as artifacts.
+const tmpPrefix = ".tmp-"
+
+// How long a lock is held without being refreshed, before another run can acquire it.
+const LockTTL = 30 * time.Second
+
+// Serves cache artifacts from a directory with the artifact API of a Turborepo remote cache,
+// along with endpoints for locking the cache of a workspace.
+// Every request must be authenticated with the bearer token.
+// Locks are only kept in memory, so they don't survive a restart of the server.
+type Server struct {
+	dir   string
+	token string
+	// The maximum total size of the artifacts in bytes, or 0 for no limit
+	maxSize int64
+	mux     *http.ServeMux
+	// Artifacts ordered from most to least recently used
+	lru *list.List
+	// Map from artifact hashes to their elements in the LRU list
+	artifacts map[string]*list.Element
+	size      int64
+	// Locks mapped by the name of the workspace whose cache they lock
+	locks   map[string]heldLock
+	lockTTL time.Duration
+	mutex   sync.Mutex
+}
+
+// A lock is identified by a random ID, so that only the run that acquired it can refresh or release it.
+// A lock that isn't refreshed expires, so a run that crashed doesn't hold it forever.
+type heldLock struct {
+	id      string
+	expires time.Time
+}
+
+// The response to acquiring a lock. The lock must be refreshed within the TTL, in milliseconds.
+type lockResponse struct {
+	Id  string `json:"id"`
+	Ttl int64  `json:"ttl"`
+}
+
+type artifact struct {
+	hash string
+	size int64
+}
+
+// Artifacts that are already in the directory are loaded in the order they were last used.
+// Locks expire when they aren't refreshed within the lock TTL.
+func NewServer(dir, token string, maxSize int64, lockTTL time.Duration) (*Server, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %q: %v", dir, err)
+	}
+
+	s := &Server{
+		dir:       dir,
+		token:     token,
+		maxSize:   maxSize,
+		mux:       http.NewServeMux(),
+		lru:       list.New(),
+		artifacts: map[string]*list.Element{},
+		locks:     map[string]heldLock{},
+		lockTTL:   lockTTL,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.mux.HandleFunc("GET /v8/artifacts/{hash}", s.getArtifact)
+	s.mux.HandleFunc("HEAD /v8/artifacts/{hash}", s.getArtifact)
+	s.mux.HandleFunc("PUT /v8/artifacts/{hash}", s.putArtifact)
+	s.mux.HandleFunc("POST /v8/locks/{workspace}", s.lock)
+	s.mux.HandleFunc("PUT /v8/locks/{workspace}/{id}", s.refreshLock)
+	s.mux.HandleFunc("DELETE /v8/locks/{workspace}/{id}", s.unlock)
+	s.mux.HandleFunc("DELETE /v8/locks/{workspace}", s.forceUnlock)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthorized(r) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	start := time.Now()
+	s.mux.ServeHTTP(w, r)
+	log.Debug("served request", "method", r.Method, "path", r.URL.Path, "duration", time.Since(start))
+}
+
+func (s *Server) isAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory %q: %v", s.dir, err)
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		// Temporary files are left behind when the server stops during an upload
+		if strings.HasPrefix(entry.Name(), tmpPrefix) {
+			os.Remove(filepath.Join(s.dir, entry.Name()))
+			continue
+		}
+		if entry.IsDir() || !isValidHash(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to read cache artifact %q: %v", entry.Name(), err)
+		}
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, info := range infos {
+		s.artifacts[info.Name()] = s.lru.PushFront(artifact{hash: info.Name(), size: info.Size()})
+		s.size += info.Size()
+	}
+	return nil
+}
+
+func (s *Server) getArtifact(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !isValidHash(hash) {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	el, ok := s.artifacts[hash]
+	if ok {
+		s.lru.MoveToFront(el)
+	}
+	// The file is opened while the lock is held, so it can't be evicted in between
+	file, err := os.Open(filepath.Join(s.dir, hash))
+	s.mutex.Unlock()
+	if !ok || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	// The modification time records when the artifact was last used, so the order survives restarts
+	now := time.Now()
+	if err := os.Chtimes(file.Name(), now, now); err != nil {
+		log.Warn("failed to update modification time", "path", file.Name(), "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(el.Value.(artifact).size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		log.Warn("failed to send artifact", "hash", hash, "error", err)
+	}
+}
+
+func (s *Server) putArtifact(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !isValidHash(hash) {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	body := r.Body
+	if s.maxSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.maxSize)
+	}
+	size, err := s.writeArtifact(hash, body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "artifact exceeds the size limit of the cache", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mutex.Lock()
+	if el, ok := s.artifacts[hash]; ok {
+		s.size -= el.Value.(artifact).size
+		s.lru.Remove(el)
+	}
+	s.artifacts[hash] = s.lru.PushFront(artifact{hash: hash, size: size})
+	s.size += size
+	s.evict()
+	s.mutex.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// The artifact is written to a temporary file first, so that a failed upload never replaces an artifact.
+func (s *Server) writeArtifact(hash string, r io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp(s.dir, tmpPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write cache artifact: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, hash)); err != nil {
+		return 0, fmt.Errorf("failed to write cache artifact: %v", err)
+	}
+	return size, nil
+}
+
+// Removes the least recently used artifacts until the cache fits in its size limit.
+// The mutex must be held.
+func (s *Server) evict() {
+	for s.maxSize > 0 && s.size > s.maxSize {
+		el := s.lru.Back()
+		a := el.Value.(artifact)
+		if err := os.Remove(filepath.Join(s.dir, a.hash)); err != nil && !os.IsNotExist(err) {
+			log.Error(fmt.Errorf("failed to evict cache artifact %q: %v", a.hash, err))
+			return
+		}
+
+		s.lru.Remove(el)
+		delete(s.artifacts, a.hash)
+		s.size -= a.size
+		log.Info("evicted artifact", "hash", a.hash, "size", a.size)
+	}
+}
+
+func (s *Server) lock(w http.ResponseWriter, r *http.Request) {
+	workspace := r.PathValue("workspace")
+	id, err := newLockId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if l, ok := s.locks[workspace]; ok {
+		if time.Now().Before(l.expires) {
+			http.Error(w, "lock is already acquired", http.StatusConflict)
+			return
+		}
+		log.Info("lock expired", "workspace", workspace)
+	}
+	s.locks[workspace] = heldLock{id: id, expires: time.Now().Add(s.lockTTL)}
+	log.Info("acquired lock", "workspace", workspace)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lockResponse{Id: id, Ttl: s.lockTTL.Milliseconds()}); err != nil {
+		log.Warn("failed to send lock", "workspace", workspace, "error", err)
+	}
+}
+
+// A lock that expired can still be refreshed, as long as no other run acquired it in the meantime.
+func (s *Server) refreshLock(w http.ResponseWriter, r *http.Request) {
+	workspace := r.PathValue("workspace")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l, ok := s.locks[workspace]
+	if !ok || l.id != r.PathValue("id") {
+		http.Error(w, "lock is not held", http.StatusConflict)
+		return
+	}
+	l.expires = time.Now().Add(s.lockTTL)
+	s.locks[workspace] = l
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) unlock(w http.ResponseWriter, r *http.Request) {
+	workspace := r.PathValue("workspace")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l, ok := s.locks[workspace]
+	if ok && l.id != r.PathValue("id") {
+		http.Error(w, "lock was acquired by another run", http.StatusConflict)
+		return
+	}
+	delete(s.locks, workspace)
+	log.Info("released lock", "workspace", workspace)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Removes the lock no matter which run holds it, for 'omni unlock'.
+func (s *Server) forceUnlock(w http.ResponseWriter, r *http.Request) {
+	workspace := r.PathValue("workspace")
+
+	s.mutex.Lock()
+	delete(s.locks, workspace)
+	s.mutex.Unlock()
+	log.Info("removed lock", "workspace", workspace)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newLockId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate lock ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Hashes are used as file names, so they can't contain path separators or dots.
+func isValidHash(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	for _, c := range hash {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,270 @@
+package server_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/service/server"
+	"github.com/mitchelldw01/omnirepo/internal/service/turbo"
+)
+
+const token = "token"
+
+func newTestServer(t *testing.T, dir string, maxSize int64) *httptest.Server {
+	srv, err := server.NewServer(dir, token, maxSize, server.LockTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func newTestLockServer(t *testing.T, lockTTL time.Duration) *httptest.Server {
+	srv, err := server.NewServer(t.TempDir(), token, 0, lockTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestArtifacts(t *testing.T) {
+	t.Run("should serve artifacts that were uploaded", func(t *testing.T) {
+		ts := newTestServer(t, t.TempDir(), 0)
+		trans := turbo.NewTurboTransport(ts.URL, token, "", "omnirepo")
+		writeTestArtifact(t, trans, "a", "body")
+
+		if res := readTestArtifact(t, trans, "a"); res != "body" {
+			t.Fatalf("expected %q, got %q", "body", res)
+		}
+	})
+
+	t.Run("should serve artifacts from a previous server", func(t *testing.T) {
+		dir := t.TempDir()
+		writeTestArtifact(t, turbo.NewTurboTransport(newTestServer(t, dir, 0).URL, token, "", "omnirepo"), "a", "body")
+
+		trans := turbo.NewTurboTransport(newTestServer(t, dir, 0).URL, token, "", "omnirepo")
+		if res := readTestArtifact(t, trans, "a"); res != "body" {
+			t.Fatalf("expected %q, got %q", "body", res)
+		}
+	})
+
+	t.Run("should reject requests with an invalid token", func(t *testing.T) {
+		ts := newTestServer(t, t.TempDir(), 0)
+		res, err := http.Get(ts.URL + "/v8/artifacts/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, res.StatusCode)
+		}
+	})
+
+	t.Run("should reject artifacts that exceed the size limit", func(t *testing.T) {
+		ts := newTestServer(t, t.TempDir(), 4)
+		trans := turbo.NewTurboTransport(ts.URL, token, "", "omnirepo")
+
+		w, err := trans.Writer("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("too large")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestEviction(t *testing.T) {
+	ts := newTestServer(t, t.TempDir(), 10)
+	trans := turbo.NewTurboTransport(ts.URL, token, "", "omnirepo")
+
+	writeTestArtifact(t, trans, "a", "aaaa")
+	writeTestArtifact(t, trans, "b", "bbbb")
+	// reading the first artifact makes the second one the least recently used
+	readTestArtifact(t, trans, "a")
+	writeTestArtifact(t, trans, "c", "cccc")
+
+	if _, err := trans.Reader("b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the least recently used artifact to be evicted, got %v", err)
+	}
+	for _, path := range []string{"a", "c"} {
+		readTestArtifact(t, trans, path)
+	}
+}
+
+func TestServerLock(t *testing.T) {
+	ts := newTestServer(t, t.TempDir(), 0)
+	lock := server.NewServerLock(ts.URL, token, "omnirepo")
+
+	if err := lock.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Lock(); err == nil || !strings.Contains(err.Error(), "already acquired") {
+		t.Fatalf("expected the lock to be acquired already, got %v", err)
+	}
+	if err := server.NewServerLock(ts.URL, token, "other").Lock(); err != nil {
+		t.Fatalf("expected the locks of workspaces to be independent, got %v", err)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Lock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerLockExpiry(t *testing.T) {
+	t.Run("should let another run acquire a lock that is not refreshed", func(t *testing.T) {
+		ts := newTestLockServer(t, 50*time.Millisecond)
+		if _, err := acquireTestLock(ts, "omnirepo"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		if err := server.NewServerLock(ts.URL, token, "omnirepo").Lock(); err != nil {
+			t.Fatalf("expected the stale lock to expire, got %v", err)
+		}
+	})
+
+	t.Run("should keep a lock that is refreshed", func(t *testing.T) {
+		ts := newTestLockServer(t, 150*time.Millisecond)
+		lock := server.NewServerLock(ts.URL, token, "omnirepo")
+		if err := lock.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		defer lock.Unlock()
+		time.Sleep(400 * time.Millisecond)
+
+		err := server.NewServerLock(ts.URL, token, "omnirepo").Lock()
+		if err == nil || !strings.Contains(err.Error(), "already acquired") {
+			t.Fatalf("expected the lock to be acquired already, got %v", err)
+		}
+	})
+
+	t.Run("should not release a lock that was acquired by another run", func(t *testing.T) {
+		ts := newTestLockServer(t, 50*time.Millisecond)
+		id, err := acquireTestLock(ts, "omnirepo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		lock := server.NewServerLock(ts.URL, token, "omnirepo")
+		if err := lock.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		defer lock.Unlock()
+
+		status, err := sendTestLockRequest(ts, http.MethodDelete, "omnirepo/"+id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusConflict {
+			t.Fatalf("expected status %d, got %d", http.StatusConflict, status)
+		}
+		if _, err := acquireTestLock(ts, "omnirepo"); err == nil {
+			t.Fatal("expected the lock to still be held")
+		}
+	})
+
+	t.Run("should remove a lock held by another run with 'omni unlock'", func(t *testing.T) {
+		ts := newTestLockServer(t, server.LockTTL)
+		lock := server.NewServerLock(ts.URL, token, "omnirepo")
+		if err := lock.Lock(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := server.NewServerLock(ts.URL, token, "omnirepo").Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		other := server.NewServerLock(ts.URL, token, "omnirepo")
+		if err := other.Lock(); err != nil {
+			t.Fatalf("expected the lock to be removed, got %v", err)
+		}
+		defer other.Unlock()
+		if err := lock.Unlock(); err == nil {
+			t.Fatal("expected releasing a lock that was removed to fail")
+		}
+	})
+}
+
+// Acquires a lock without refreshing it, like a run that crashed.
+func acquireTestLock(ts *httptest.Server, workspace string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v8/locks/"+workspace, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	var body struct {
+		Id string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.Id, nil
+}
+
+func sendTestLockRequest(ts *httptest.Server, method, path string) (int, error) {
+	req, err := http.NewRequest(method, ts.URL+"/v8/locks/"+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func writeTestArtifact(t *testing.T, trans *turbo.TurboTransport, path, body string) {
+	w, err := trans.Writer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatalf("failed to write %q: %v", path, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestArtifact(t *testing.T, trans *turbo.TurboTransport, path string) string {
+	r, err := trans.Reader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read %q: %v", path, err)
+	}
+	return string(b)
+}
@@ -34,3 +34,19 @@ func (st SystemTransport) Writer(path string) (io.WriteCloser, error) {
 
 	return w, nil
 }
+
+// Replaces the destination artifact, so readers see either the old artifact or the new one.
+func (st SystemTransport) Rename(src, dst string) error {
+	if err := os.Rename(filepath.Join(".omni/cache", src), filepath.Join(".omni/cache", dst)); err != nil {
+		return fmt.Errorf("failed to rename cache artifact: %v", err)
+	}
+	return nil
+}
+
+// Removing an artifact that doesn't exist isn't an error.
+func (st SystemTransport) Remove(path string) error {
+	if err := os.Remove(filepath.Join(".omni/cache", path)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cache artifact: %v", err)
+	}
+	return nil
+}
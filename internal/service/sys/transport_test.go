@@ -87,6 +87,57 @@ func TestWriter(t *testing.T) {
 	}
 }
 
+func TestRename(t *testing.T) {
+	dir, err := changeWorkingDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createTestFile(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sys.NewSystemTransport().Rename(key, "renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(".omni/cache", key)); !os.IsNotExist(err) {
+		t.Fatalf("expected %q to be renamed", key)
+	}
+
+	b, err := os.ReadFile(filepath.Join(".omni/cache", "renamed.txt"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if res := string(b); res != body {
+		t.Errorf("expected %q, got %q", body, res)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	dir, err := changeWorkingDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := createTestFile(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	trans := sys.NewSystemTransport()
+	if err := trans.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(".omni/cache", key)); !os.IsNotExist(err) {
+		t.Fatalf("expected %q to be removed", key)
+	}
+
+	if err := trans.Remove(key); err != nil {
+		t.Fatalf("expected no error when the file does not exist, got %v", err)
+	}
+}
+
 func changeWorkingDirectory() (string, error) {
 	dir, err := os.MkdirTemp("", "omnirepo-")
 	if err != nil {
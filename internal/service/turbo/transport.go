@@ -0,0 +1,155 @@
+package turbo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitchelldw01/omnirepo/internal/trace"
+)
+
+func startSpan(name, method, addr string) *trace.Span {
+	span := trace.Start(name)
+	span.SetAttribute("method", method)
+	span.SetAttribute("url", addr)
+	return span
+}
+
+// Reads and writes cache artifacts with the artifact API of a Turborepo remote cache.
+// The API stores artifacts by hash, so every path is mapped to the hash of the workspace name and the path.
+type TurboTransport struct {
+	client    *http.Client
+	baseUrl   string
+	token     string
+	team      string
+	workspace string
+}
+
+func NewTurboTransport(baseUrl, token, team, workspace string) *TurboTransport {
+	return &TurboTransport{
+		client:    &http.Client{Timeout: 60 * time.Second},
+		baseUrl:   strings.TrimSuffix(baseUrl, "/"),
+		token:     token,
+		team:      team,
+		workspace: workspace,
+	}
+}
+
+func (t *TurboTransport) Reader(path string) (io.ReadCloser, error) {
+	res, err := t.do(http.MethodGet, path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to read cache artifact %q: %w", path, os.ErrNotExist)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to read cache artifact %q: unexpected status %q", path, res.Status)
+	}
+
+	return res.Body, nil
+}
+
+func (t *TurboTransport) Writer(path string) (io.WriteCloser, error) {
+	tmp, err := os.CreateTemp("", "turbo-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write cache artifact: %v", err)
+	}
+
+	return &TurboUploader{
+		transport: t,
+		file:      tmp,
+		path:      path,
+	}, nil
+}
+
+// Sends an authenticated request for the artifact at the given path.
+func (t *TurboTransport) do(method, path string, body io.Reader, size int64) (*http.Response, error) {
+	addr := t.artifactUrl(path)
+	span := startSpan("turbo."+method, method, addr)
+	defer span.End()
+
+	req, err := http.NewRequest(method, addr, body)
+	if err != nil {
+		span.SetError(err.Error())
+		return nil, fmt.Errorf("failed to create request for cache artifact %q: %v", path, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = size
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		span.SetError(err.Error())
+		return nil, fmt.Errorf("failed to request cache artifact %q: %v", path, err)
+	}
+	span.SetAttribute("status", res.StatusCode)
+	return res, nil
+}
+
+// Teams are identified by ID when it has the "team_" prefix, and by slug otherwise, like Turborepo does.
+func (t *TurboTransport) artifactUrl(path string) string {
+	hash := sha256.Sum256([]byte(t.workspace + "/" + path))
+	u := fmt.Sprintf("%s/v8/artifacts/%s", t.baseUrl, hex.EncodeToString(hash[:]))
+	if t.team == "" {
+		return u
+	}
+
+	query := url.Values{}
+	if strings.HasPrefix(t.team, "team_") {
+		query.Set("teamId", t.team)
+	} else {
+		query.Set("slug", t.team)
+	}
+	return u + "?" + query.Encode()
+}
+
+// Buffers an artifact in a temporary file, and uploads it when it's closed.
+type TurboUploader struct {
+	transport *TurboTransport
+	file      *os.File
+	path      string
+}
+
+func (u *TurboUploader) Write(b []byte) (int, error) {
+	n, err := u.file.Write(b)
+	if err != nil {
+		return n, fmt.Errorf("failed to write cache artifact: %v", err)
+	}
+	return n, nil
+}
+
+func (u *TurboUploader) Close() error {
+	defer os.Remove(u.file.Name())
+	defer u.file.Close()
+
+	info, err := u.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to write cache artifact: %v", err)
+	}
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to write cache artifact: %v", err)
+	}
+
+	res, err := u.transport.do(http.MethodPut, u.path, u.file, info.Size())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("failed to write cache artifact %q: unexpected status %q", u.path, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package turbo_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mitchelldw01/omnirepo/internal/service/turbo"
+)
+
+const (
+	key   = "test.txt"
+	body  = "lorem ipsum dolor sit amet"
+	token = "token"
+)
+
+// Implements the artifact API of a Turborepo remote cache in memory.
+type artifactServer struct {
+	artifacts map[string][]byte
+	// The query of the last request
+	query string
+	mutex sync.Mutex
+}
+
+func newArtifactServer(t *testing.T) (*httptest.Server, *artifactServer) {
+	s := &artifactServer{artifacts: map[string][]byte{}}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return server, s
+}
+
+func (s *artifactServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash, ok := strings.CutPrefix(r.URL.Path, "/v8/artifacts/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.query = r.URL.RawQuery
+
+	switch r.Method {
+	case http.MethodGet:
+		b, ok := s.artifacts[hash]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.artifacts[hash] = b
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestReader(t *testing.T) {
+	t.Run("should read an artifact that was written", func(t *testing.T) {
+		server, _ := newArtifactServer(t)
+		trans := turbo.NewTurboTransport(server.URL, token, "", "omnirepo")
+		if err := writeArtifact(trans, key, body); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := trans.Reader(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to read from reader: %v", err)
+		}
+		if res := string(b); res != body {
+			t.Fatalf("expected %q, got %q", body, res)
+		}
+	})
+
+	t.Run("should return a not exist error when the artifact does not exist", func(t *testing.T) {
+		server, _ := newArtifactServer(t)
+		trans := turbo.NewTurboTransport(server.URL, token, "", "omnirepo")
+
+		if _, err := trans.Reader(key); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected a not exist error, got %v", err)
+		}
+	})
+
+	t.Run("should keep the artifacts of workspaces apart", func(t *testing.T) {
+		server, _ := newArtifactServer(t)
+		if err := writeArtifact(turbo.NewTurboTransport(server.URL, token, "", "omnirepo"), key, body); err != nil {
+			t.Fatal(err)
+		}
+
+		trans := turbo.NewTurboTransport(server.URL, token, "", "other")
+		if _, err := trans.Reader(key); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected a not exist error, got %v", err)
+		}
+	})
+}
+
+func TestWriter(t *testing.T) {
+	t.Run("should upload the artifact when the writer is closed", func(t *testing.T) {
+		server, s := newArtifactServer(t)
+		trans := turbo.NewTurboTransport(server.URL, token, "", "omnirepo")
+		if err := writeArtifact(trans, key, body); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.artifacts) != 1 {
+			t.Fatalf("expected 1 artifact, got %d", len(s.artifacts))
+		}
+	})
+
+	t.Run("should return an error when the token is invalid", func(t *testing.T) {
+		server, _ := newArtifactServer(t)
+		trans := turbo.NewTurboTransport(server.URL, "invalid", "", "omnirepo")
+
+		if err := writeArtifact(trans, key, body); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestTeam(t *testing.T) {
+	testCases := []struct {
+		name     string
+		team     string
+		expected string
+	}{
+		{
+			name:     "should identify the team by ID when it has the team_ prefix",
+			team:     "team_123",
+			expected: "teamId=team_123",
+		},
+		{
+			name:     "should identify the team by slug otherwise",
+			team:     "my-team",
+			expected: "slug=my-team",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, s := newArtifactServer(t)
+			trans := turbo.NewTurboTransport(server.URL, token, tc.team, "omnirepo")
+			if err := writeArtifact(trans, key, body); err != nil {
+				t.Fatal(err)
+			}
+
+			if s.query != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, s.query)
+			}
+		})
+	}
+}
+
+func writeArtifact(trans *turbo.TurboTransport, path, body string) error {
+	w, err := trans.Writer(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
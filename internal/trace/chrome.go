@@ -0,0 +1,80 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Writes spans to a file in the Chrome Trace Event format, which can be opened with Perfetto or chrome://tracing.
+type ChromeExporter struct {
+	path string
+}
+
+func NewChromeExporter(path string) *ChromeExporter {
+	return &ChromeExporter{path: path}
+}
+
+type chromeTrace struct {
+	TraceEvents     []chromeEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+// A complete event, with timestamps in microseconds.
+type chromeEvent struct {
+	Name      string         `json:"name"`
+	Phase     string         `json:"ph"`
+	Timestamp int64          `json:"ts"`
+	Duration  int64          `json:"dur"`
+	ProcessId int            `json:"pid"`
+	ThreadId  int            `json:"tid"`
+	Args      map[string]any `json:"args"`
+}
+
+// Timestamps are relative to the earliest span, so that traces start at zero.
+func (e *ChromeExporter) Export(spans []SpanData) error {
+	sorted := slices.Clone(spans)
+	slices.SortStableFunc(sorted, func(a, b SpanData) int {
+		return a.Start.Compare(b.Start)
+	})
+
+	var origin time.Time
+	if len(sorted) > 0 {
+		origin = sorted[0].Start
+	}
+
+	events := make([]chromeEvent, 0, len(sorted))
+	for _, span := range sorted {
+		if span.Error != "" {
+			span.Attributes = maps.Clone(span.Attributes)
+			span.Attributes["error"] = span.Error
+		}
+		events = append(events, chromeEvent{
+			Name:      span.Name,
+			Phase:     "X",
+			Timestamp: span.Start.Sub(origin).Microseconds(),
+			Duration:  span.End.Sub(span.Start).Microseconds(),
+			ProcessId: 1,
+			ThreadId:  span.Lane,
+			Args:      span.Attributes,
+		})
+	}
+
+	b, err := json.Marshal(chromeTrace{TraceEvents: events, DisplayTimeUnit: "ms"})
+	if err != nil {
+		return fmt.Errorf("failed to marshal trace: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(e.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create trace directory: %v", err)
+	}
+	if err := os.WriteFile(e.path, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write trace %q: %v", e.path, err)
+	}
+
+	return nil
+}
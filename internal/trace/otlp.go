@@ -0,0 +1,235 @@
+package trace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sends spans to an OpenTelemetry collector using the JSON encoding of OTLP/HTTP.
+type OtlpExporter struct {
+	url     string
+	headers map[string]string
+	service string
+	// Every span of a run belongs to the same trace
+	traceId string
+	client  *http.Client
+}
+
+func NewOtlpExporter(url string, headers map[string]string, service string) (*OtlpExporter, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate trace ID: %v", err)
+	}
+
+	return &OtlpExporter{
+		url:     url,
+		headers: headers,
+		service: service,
+		traceId: hex.EncodeToString(id),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Creates an exporter from the standard OpenTelemetry environment variables.
+// Returns nil when neither OTEL_EXPORTER_OTLP_TRACES_ENDPOINT nor OTEL_EXPORTER_OTLP_ENDPOINT is set.
+func NewOtlpExporterFromEnv() (*OtlpExporter, error) {
+	url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if url == "" {
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			return nil, nil
+		}
+		url = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+
+	headers := parseOtlpHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	for key, val := range parseOtlpHeaders(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")) {
+		headers[key] = val
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "omni"
+	}
+
+	return NewOtlpExporter(url, headers, service)
+}
+
+// Parses headers in the form "key1=val1,key2=val2".
+func parseOtlpHeaders(val string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(val, ",") {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return headers
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Span kinds and status codes defined by OTLP.
+const (
+	otlpKindInternal = 1
+	otlpStatusOk     = 1
+	otlpStatusError  = 2
+)
+
+func (e *OtlpExporter) Export(spans []SpanData) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(e.newRequest(spans))
+	if err != nil {
+		return fmt.Errorf("failed to marshal spans: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to export spans: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, val := range e.headers {
+		req.Header.Set(key, val)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export spans: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("failed to export spans: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+func (e *OtlpExporter) newRequest(spans []SpanData) otlpRequest {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, e.newSpan(span))
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{newOtlpAttribute("service.name", e.service)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "omni"},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+func (e *OtlpExporter) newSpan(span SpanData) otlpSpan {
+	attrs := make([]otlpAttribute, 0, len(span.Attributes))
+	for key, val := range span.Attributes {
+		attrs = append(attrs, newOtlpAttribute(key, val))
+	}
+
+	status := otlpStatus{Code: otlpStatusOk}
+	if span.Error != "" {
+		status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+	}
+
+	var parentId string
+	if span.ParentId != 0 {
+		parentId = formatSpanId(span.ParentId)
+	}
+
+	return otlpSpan{
+		TraceId:           e.traceId,
+		SpanId:            formatSpanId(span.Id),
+		ParentSpanId:      parentId,
+		Name:              span.Name,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        attrs,
+		Status:            status,
+	}
+}
+
+func formatSpanId(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+// Integers are encoded as strings, as required by the JSON encoding of OTLP.
+func newOtlpAttribute(key string, val any) otlpAttribute {
+	var value map[string]any
+	switch v := val.(type) {
+	case string:
+		value = map[string]any{"stringValue": v}
+	case bool:
+		value = map[string]any{"boolValue": v}
+	case int:
+		value = map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		value = map[string]any{"doubleValue": v}
+	default:
+		value = map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+
+	return otlpAttribute{Key: key, Value: value}
+}
@@ -0,0 +1,193 @@
+package trace
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Receives every span that ended during a run once the run is finished.
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// The recorded state of a span that has ended.
+type SpanData struct {
+	Id       uint64
+	ParentId uint64
+	Name     string
+	// Spans on the same lane never overlap unless they're nested
+	Lane       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	// Empty unless the operation failed
+	Error string
+}
+
+// A timed operation within a run. Nil spans are valid and record nothing,
+// so callers don't need to check whether tracing is enabled.
+type Span struct {
+	data  SpanData
+	mutex sync.Mutex
+	// Whether the span owns its lane and must release it when it ends
+	ownsLane bool
+}
+
+type recorder struct {
+	exporters []Exporter
+	root      *Span
+	ended     []SpanData
+	nextId    uint64
+	// Lanes that are in use by a span that hasn't ended
+	lanes map[int]struct{}
+	mutex sync.Mutex
+}
+
+// Nil when tracing is disabled
+var rec *recorder
+
+// Enables tracing for the rest of the process. Spans are exported when Flush is called.
+func Enable(exporters ...Exporter) {
+	rec = &recorder{
+		exporters: exporters,
+		ended:     []SpanData{},
+		lanes:     map[int]struct{}{},
+	}
+}
+
+// Starts the root span of a run. Spans created with Start are its children.
+func StartRun(name string) *Span {
+	if rec == nil {
+		return nil
+	}
+
+	span := rec.newSpan(name, 0, true)
+	rec.mutex.Lock()
+	rec.root = span
+	rec.mutex.Unlock()
+	return span
+}
+
+// Starts a span on its own lane as a child of the root span.
+func Start(name string) *Span {
+	if rec == nil {
+		return nil
+	}
+
+	var parentId uint64
+	rec.mutex.Lock()
+	if rec.root != nil {
+		parentId = rec.root.data.Id
+	}
+	rec.mutex.Unlock()
+
+	return rec.newSpan(name, parentId, true)
+}
+
+// Starts a child span on the same lane as its parent.
+func (s *Span) Start(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	child := rec.newSpan(name, s.data.Id, false)
+	child.data.Lane = s.data.Lane
+	return child
+}
+
+func (s *Span) SetAttribute(key string, val any) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.data.Attributes[key] = val
+	s.mutex.Unlock()
+}
+
+// Marks the span as failed.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.data.Error = msg
+	s.mutex.Unlock()
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.data.End = time.Now()
+	data := s.data
+	s.mutex.Unlock()
+
+	rec.mutex.Lock()
+	rec.ended = append(rec.ended, data)
+	if s.ownsLane {
+		delete(rec.lanes, data.Lane)
+	}
+	rec.mutex.Unlock()
+}
+
+// Exports every span that has ended and clears them from the recorder.
+func Flush() error {
+	if rec == nil {
+		return nil
+	}
+
+	rec.mutex.Lock()
+	spans := rec.ended
+	rec.ended = []SpanData{}
+	rec.mutex.Unlock()
+
+	errs := []error{}
+	for _, exp := range rec.exporters {
+		if err := exp.Export(spans); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r *recorder) newSpan(name string, parentId uint64, ownsLane bool) *Span {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.nextId++
+	span := &Span{
+		data: SpanData{
+			Id:         r.nextId,
+			ParentId:   parentId,
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: map[string]any{},
+		},
+		ownsLane: ownsLane,
+	}
+	if ownsLane {
+		span.data.Lane = r.acquireLane()
+	}
+
+	return span
+}
+
+// Returns the lowest lane that isn't in use. Must be called while holding the mutex.
+func (r *recorder) acquireLane() int {
+	lane := 0
+	for {
+		if _, ok := r.lanes[lane]; !ok {
+			break
+		}
+		lane++
+	}
+
+	r.lanes[lane] = struct{}{}
+	return lane
+}
@@ -0,0 +1,185 @@
+package trace_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchelldw01/omnirepo/internal/trace"
+)
+
+type exporter struct {
+	spans []trace.SpanData
+}
+
+func (e *exporter) Export(spans []trace.SpanData) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestSpans(t *testing.T) {
+	t.Run("should not record spans when tracing is disabled", func(t *testing.T) {
+		span := trace.Start("task")
+		span.SetAttribute("key", "val")
+		span.Start("child").End()
+		span.End()
+
+		if span != nil {
+			t.Fatalf("expected a nil span, got %+v", span)
+		}
+	})
+
+	t.Run("should nest spans and assign lanes", func(t *testing.T) {
+		exp := exporter{}
+		trace.Enable(&exp)
+
+		run := trace.StartRun("run")
+		first := trace.Start("first")
+		second := trace.Start("second")
+		child := first.Start("child")
+		child.SetAttribute("key", "val")
+		child.End()
+		first.End()
+		second.End()
+		run.End()
+
+		if err := trace.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		spans := map[string]trace.SpanData{}
+		for _, span := range exp.spans {
+			spans[span.Name] = span
+		}
+		if len(spans) != 4 {
+			t.Fatalf("expected %d spans, got %d", 4, len(spans))
+		}
+
+		if spans["first"].ParentId != spans["run"].Id || spans["child"].ParentId != spans["first"].Id {
+			t.Fatalf("expected spans to be nested, got %+v", spans)
+		}
+		if spans["first"].Lane == spans["second"].Lane || spans["child"].Lane != spans["first"].Lane {
+			t.Fatalf("expected concurrent spans on separate lanes, got %+v", spans)
+		}
+		if spans["child"].Attributes["key"] != "val" {
+			t.Fatalf("expected attribute %q, got %v", "val", spans["child"].Attributes["key"])
+		}
+	})
+}
+
+func TestChromeExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	trace.Enable(trace.NewChromeExporter(path))
+
+	run := trace.StartRun("run")
+	trace.Start("task").End()
+	run.End()
+
+	if err := trace.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read trace: %v", err)
+	}
+
+	var res struct {
+		TraceEvents []struct {
+			Name  string `json:"name"`
+			Phase string `json:"ph"`
+			Ts    int64  `json:"ts"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("failed to unmarshal trace: %v", err)
+	}
+
+	if len(res.TraceEvents) != 2 {
+		t.Fatalf("expected %d events, got %d", 2, len(res.TraceEvents))
+	}
+	if first := res.TraceEvents[0]; first.Name != "run" || first.Phase != "X" || first.Ts != 0 {
+		t.Fatalf("expected the run to be the first complete event, got %+v", first)
+	}
+}
+
+func TestOtlpExporter(t *testing.T) {
+	type request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceId      string `json:"traceId"`
+					SpanId       string `json:"spanId"`
+					ParentSpanId string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Attributes   []struct {
+						Key   string         `json:"key"`
+						Value map[string]any `json:"value"`
+					} `json:"attributes"`
+					Status struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	var req request
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		header = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer token")
+	exp, err := trace.NewOtlpExporterFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace.Enable(exp)
+
+	run := trace.StartRun("run")
+	task := trace.Start("foo:build")
+	task.SetAttribute("exitCode", 1)
+	task.SetError("task exited with code 1")
+	task.End()
+	run.End()
+
+	if err := trace.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if header != "Bearer token" {
+		t.Fatalf("expected header %q, got %q", "Bearer token", header)
+	}
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected %d spans, got %d", 2, len(spans))
+	}
+
+	taskSpan, runSpan := spans[0], spans[1]
+	if taskSpan.TraceId != runSpan.TraceId || len(taskSpan.TraceId) != 32 {
+		t.Fatalf("expected spans to share a trace ID, got %q and %q", taskSpan.TraceId, runSpan.TraceId)
+	}
+	if taskSpan.ParentSpanId != runSpan.SpanId || runSpan.ParentSpanId != "" {
+		t.Fatalf("expected %q to be the parent of %q", runSpan.Name, taskSpan.Name)
+	}
+	if taskSpan.Status.Code != 2 {
+		t.Fatalf("expected error status %d, got %d", 2, taskSpan.Status.Code)
+	}
+	if attr := taskSpan.Attributes[0]; attr.Key != "exitCode" || attr.Value["intValue"] != "1" {
+		t.Fatalf("expected the exit code attribute, got %+v", attr)
+	}
+}
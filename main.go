@@ -1,15 +1,20 @@
 package main
 
 import (
+	"cmp"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/mitchelldw01/omnirepo/internal/cache"
+	"github.com/mitchelldw01/omnirepo/internal/exec"
 	"github.com/mitchelldw01/omnirepo/internal/log"
 	"github.com/mitchelldw01/omnirepo/run"
+	"github.com/mitchelldw01/omnirepo/usercfg"
 )
 
 var version = "dev"
@@ -17,7 +22,7 @@ var version = "dev"
 func main() {
 	args, opts, err := parseRawArguments(os.Args[1:])
 	if err != nil {
-		log.Fatal(err)
+		exit(err)
 	}
 
 	if opts.Help {
@@ -30,22 +35,47 @@ func main() {
 		return
 	}
 
+	cache.Version = version
 	if err := processCommand(args, opts); err != nil {
-		log.Fatal(err)
+		exit(err)
 	}
 }
 
+// Task failures have already been reported by the time they're returned, so they aren't printed again.
+func exit(err error) {
+	if !errors.Is(err, exec.ErrTaskFailure) {
+		log.Error(err)
+	}
+	os.Exit(run.ExitCode(err))
+}
+
 func parseRawArguments(args []string) ([]string, run.Options, error) {
 	fs := flag.NewFlagSet("omni", flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
 	opts := run.Options{}
 
+	fs.StringVar(&opts.Cache, "cache", "", "")
+	fs.StringVar(&opts.Concurrency, "concurrency", "", "")
+	fs.BoolVar(&opts.Continue, "continue", false, "")
+	fs.StringVar(&opts.Dir, "dir", "", "")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "")
+	fs.BoolVar(&opts.FailFast, "fail-fast", false, "")
+	fs.StringVar(&opts.Format, "format", log.Text, "")
+	fs.DurationVar(&opts.GracePeriod, "grace-period", 10*time.Second, "")
 	fs.BoolVar(&opts.Help, "help", false, "")
 	fs.BoolVar(&opts.Help, "h", false, "")
+	fs.StringVar(&opts.JUnit, "junit", "", "")
+	fs.StringVar(&opts.Listen, "listen", "localhost:8080", "")
+	fs.StringVar(&opts.LogLevel, "log-level", "", "")
+	fs.StringVar(&opts.MaxSize, "max-size", "", "")
 	fs.BoolVar(&opts.NoCache, "no-cache", false, "")
 	fs.BoolVar(&opts.NoColor, "no-color", false, "")
+	fs.StringVar(&opts.Output, "output", log.Grouped, "")
+	fs.StringVar(&opts.OutputLogs, "output-logs", "", "")
+	fs.StringVar(&opts.Profile, "profile", "", "")
 	fs.BoolVar(&opts.Remote, "remote", false, "")
 	fs.BoolVar(&opts.Remote, "r", false, "")
+	fs.Var(&summaryFlag{opts: &opts}, "summary", "")
 	fs.StringVar(&opts.Target, "target", "", "")
 	fs.StringVar(&opts.Target, "t", "", "")
 	fs.BoolVar(&opts.Version, "version", false, "")
@@ -55,6 +85,35 @@ func parseRawArguments(args []string) ([]string, run.Options, error) {
 	return fs.Args(), opts, err
 }
 
+// A bare --summary writes the summary to .omni/runs, and --summary=<PATH> writes it to a specific file.
+// It's a boolean flag, so that it never takes the next argument as its path.
+type summaryFlag struct {
+	opts *run.Options
+}
+
+func (f *summaryFlag) String() string {
+	if f.opts == nil {
+		return ""
+	}
+	return f.opts.SummaryPath
+}
+
+func (f *summaryFlag) Set(val string) error {
+	switch val {
+	case "true", "":
+		f.opts.Summary, f.opts.SummaryPath = true, ""
+	case "false":
+		f.opts.Summary, f.opts.SummaryPath = false, ""
+	default:
+		f.opts.Summary, f.opts.SummaryPath = true, val
+	}
+	return nil
+}
+
+func (f *summaryFlag) IsBoolFlag() bool {
+	return true
+}
+
 func printHelpMenu() {
 	code := log.Bold + log.Underline
 	text := "High performance task-runner for any codebase\n\n"
@@ -63,15 +122,35 @@ func printHelpMenu() {
 	text += fmt.Sprintf("%sCommands:%s\n", code, log.Reset)
 	text += "    unlock                             Forcefully unlock the cache\n"
 	text += "    tree                               Show the dependency tree as JSON\n"
+	text += "    explain <TARGET:TASK>              Show why a task would miss the cache without running it\n"
+	text += "    cache serve                        Serve a shared cache over HTTP from a directory\n"
 	text += "    run                                Run tasks (default)\n\n"
 
 	text += fmt.Sprintf("%sOptions:%s\n", code, log.Reset)
+	text += "    --cache <CACHES>                   Which caches to use and how (local,remote,read-write|read-only|write-only|off)\n"
+	text += "    --concurrency <N>                  Maximum number of tasks to run at once (e.g. 4 or 50%)\n"
+	text += "    --continue                         Keep running unrelated tasks after a failure (default)\n"
+	text += "    --dry-run                          Show which tasks would replay from the cache or execute, without running them\n"
+	text += "    --fail-fast                        Stop running tasks after the first failure\n"
+	text += "    --format <FORMAT>                  Print human readable output or JSON events (text|json)\n"
+	text += "    --grace-period <DURATION>          Time for tasks to exit after an interrupt (default 10s)\n"
 	text += "    -h, --help                         Show help\n"
-	text += "    --no-cache                         Invalidate the cache before running task\n"
+	text += "    --junit <PATH>                     Write a JUnit XML report of task results\n"
+	text += "    --log-level <LEVEL>                Write leveled logs, e.g. explaining cache decisions, to stderr (debug|info|warn)\n"
+	text += "    --no-cache                         Execute every task without reading the cache\n"
 	text += "    --no-color                         Disable color output\n"
-	text += "    -r, --remote                       Use remote cache\n"
+	text += "    --output <MODE>                    Print task logs when tasks finish or as they run (grouped|stream)\n"
+	text += "    --output-logs <MODE>               Which task logs to print (full|hash-only|new-only|errors-only|none)\n"
+	text += "    --profile <PATH>                   Write a Chrome trace of the run for Perfetto or chrome://tracing\n"
+	text += "    -r, --remote                       Use the remote cache in addition to the local cache\n"
+	text += "    --summary[=<PATH>]                 Write a JSON summary of the run to .omni/runs or to a specific file\n"
 	text += "    -t, --target <PATH>                Load tasks from specific target directory\n"
-	text += "    -v, --version                      Show version\n"
+	text += "    -v, --version                      Show version\n\n"
+
+	text += fmt.Sprintf("%sCache Server Options:%s\n", code, log.Reset)
+	text += "    --dir <PATH>                       Directory to store artifacts in (default ~/.omni/server)\n"
+	text += "    --listen <ADDR>                    Address to listen on (default localhost:8080)\n"
+	text += "    --max-size <SIZE>                  Evict the least recently used artifacts above this size (e.g. 10GB)\n"
 
 	fmt.Print(text)
 }
@@ -81,13 +160,45 @@ func processCommand(args []string, opts run.Options) error {
 		log.NoColor = true
 	}
 
+	switch opts.Output {
+	case log.Grouped, log.Stream:
+		log.Output = opts.Output
+	default:
+		return fmt.Errorf("invalid output mode %q, expected %q or %q", opts.Output, log.Grouped, log.Stream)
+	}
+
+	switch opts.Format {
+	case log.Text, log.Json:
+		log.Format = opts.Format
+	default:
+		return fmt.Errorf("invalid format %q, expected %q or %q", opts.Format, log.Text, log.Json)
+	}
+
+	// The command line option takes priority over the environment variable
+	if level := cmp.Or(opts.LogLevel, os.Getenv("OMNI_LOG")); level != "" {
+		if err := log.SetLevel(level); err != nil {
+			return err
+		}
+	}
+
+	if err := usercfg.ValidateOutputLogs(opts.OutputLogs); err != nil {
+		return err
+	}
+
+	if opts.Continue && opts.FailFast {
+		return errors.New("options '--continue' and '--fail-fast' cannot be used together")
+	}
+
 	cmd, tasks, err := parsePositionalArguments(args)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	if err := validateTaskNames(tasks); err != nil {
-		log.Fatal(err)
+	// The task of the explain command is qualified by its target directory
+	if cmd != "explain" {
+		if err := validateTaskNames(tasks); err != nil {
+			return err
+		}
 	}
 
 	return run.RunCommand(cmd, tasks, opts)
@@ -103,6 +214,16 @@ func parsePositionalArguments(args []string) (string, []string, error) {
 		return "unlock", nil, nil
 	case "tree":
 		return "tree", args[1:], nil
+	case "explain":
+		if len(args) != 2 || !strings.Contains(args[1], ":") {
+			return "", nil, errors.New("expected a single task in the form '<target>:<task>' to explain")
+		}
+		return "explain", args[1:], nil
+	case "cache":
+		if len(args) != 2 || args[1] != "serve" {
+			return "", nil, errors.New("expected 'cache serve'")
+		}
+		return "cache serve", nil, nil
 	case "run":
 		return "run", args[1:], nil
 	default:
@@ -2,19 +2,28 @@ package run
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"maps"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/mitchelldw01/omnirepo/internal/cache"
 	"github.com/mitchelldw01/omnirepo/internal/exec"
 	"github.com/mitchelldw01/omnirepo/internal/graph"
 	"github.com/mitchelldw01/omnirepo/internal/log"
+	"github.com/mitchelldw01/omnirepo/internal/report"
 	"github.com/mitchelldw01/omnirepo/internal/service/aws"
+	"github.com/mitchelldw01/omnirepo/internal/service/reapi"
+	"github.com/mitchelldw01/omnirepo/internal/service/server"
 	"github.com/mitchelldw01/omnirepo/internal/service/sys"
+	"github.com/mitchelldw01/omnirepo/internal/service/turbo"
+	"github.com/mitchelldw01/omnirepo/internal/trace"
 	"github.com/mitchelldw01/omnirepo/usercfg"
 )
 
@@ -25,34 +34,90 @@ type CacheLocker interface {
 	Unlock() error
 }
 
+// Reads and writes cache artifacts on the file system or in a remote cache.
+type CacheTransport interface {
+	cache.TransportReader
+	cache.TransportWriter
+}
+
+// Exit codes for the omni process.
+const (
+	ExitSuccess = 0
+	// One or more tasks failed
+	ExitTaskFailure = 1
+	// Omni itself failed, e.g. the cache could not be locked or updated
+	ExitError = 2
+	// The run was interrupted by SIGINT or SIGTERM
+	ExitInterrupted = 130
+)
+
+// Returns the exit code that the omni process should use for the given error.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitSuccess
+	case errors.Is(err, exec.ErrInterrupted):
+		return ExitInterrupted
+	case errors.Is(err, exec.ErrTaskFailure):
+		return ExitTaskFailure
+	default:
+		return ExitError
+	}
+}
+
 type Options struct {
-	Graph   bool
-	Help    bool
-	NoCache bool
-	NoColor bool
-	Remote  bool
-	Target  string
-	Version bool
+	Cache       string
+	Concurrency string
+	Continue    bool
+	Dir         string
+	DryRun      bool
+	FailFast    bool
+	Format      string
+	GracePeriod time.Duration
+	Graph       bool
+	Help        bool
+	JUnit       string
+	Listen      string
+	LogLevel    string
+	MaxSize     string
+	NoCache     bool
+	NoColor     bool
+	Output      string
+	OutputLogs  string
+	Profile     string
+	Remote      bool
+	Summary     bool
+	SummaryPath string
+	Target      string
+	Version     bool
 }
 
 func RunCommand(cmd string, tasks []string, opts Options) error {
 	switch cmd {
 	case "unlock":
-		return runUnlockCommand()
+		return runUnlockCommand(opts)
 	case "tree":
 		return runTreeCommand(tasks, opts)
+	case "explain":
+		return runExplainCommand(tasks[0], opts)
+	case "cache serve":
+		return runCacheServeCommand(opts)
 	default:
 		return runRunCommand(tasks, opts)
 	}
 }
 
-func runUnlockCommand() error {
+func runUnlockCommand(opts Options) error {
 	workCfg, err := usercfg.NewWorkspaceConfig()
 	if err != nil {
 		return err
 	}
+	cacheOpts, err := parseCacheOptions(workCfg, opts)
+	if err != nil {
+		return err
+	}
 
-	lock, err := createCacheLock(workCfg)
+	lock, err := createCacheLock(workCfg, cacheOpts)
 	if err != nil {
 		return err
 	}
@@ -71,7 +136,7 @@ func runTreeCommand(tasks []string, opts Options) error {
 		return err
 	}
 
-	graph, err := createDependencyGraph(workCfg, targetCfgs, tasks, opts)
+	graph, _, _, err := createDependencyGraph(workCfg, targetCfgs, tasks, opts)
 	if err != nil {
 		return err
 	}
@@ -85,41 +150,212 @@ func runTreeCommand(tasks []string, opts Options) error {
 	return nil
 }
 
+// Nothing is executed and the cache isn't written, so the cache doesn't need to be locked.
+func runExplainCommand(id string, opts Options) error {
+	index := strings.LastIndex(id, ":")
+	dir, name := filepath.Clean(id[:index]), id[index+1:]
+
+	workCfg, targetCfgs, err := parseConfigs(dir)
+	if err != nil {
+		return err
+	}
+
+	r, err := createCacheReader(workCfg, targetCfgs, opts)
+	if err != nil {
+		return err
+	}
+
+	id = fmt.Sprintf("%s:%s", dir, name)
+	graph := graph.NewDependencyGraph(exec.NewExplainer(r, id), targetCfgs, 1)
+	if err := graph.PopulateNodes([]string{name}, dir); err != nil {
+		return err
+	}
+
+	return graph.ExecuteTasks()
+}
+
+// The token is shared with the clients, which read it from the same environment variable.
+func runCacheServeCommand(opts Options) error {
+	token := os.Getenv("OMNI_REMOTE_CACHE_TOKEN")
+	if token == "" {
+		return errors.New("the OMNI_REMOTE_CACHE_TOKEN environment variable must be set to serve the cache")
+	}
+	maxSize, err := usercfg.ParseSize(opts.MaxSize)
+	if err != nil {
+		return err
+	}
+
+	dir := opts.Dir
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to determine cache directory: %v", err)
+		}
+		dir = filepath.Join(home, ".omni/server")
+	}
+
+	srv, err := server.NewServer(dir, token, maxSize, server.LockTTL)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Serving the cache in %q on %s\n", dir, opts.Listen)
+	httpSrv := &http.Server{Addr: opts.Listen, Handler: srv, ReadHeaderTimeout: 10 * time.Second}
+	return httpSrv.ListenAndServe()
+}
+
 func runRunCommand(tasks []string, opts Options) (err error) {
+	if opts.DryRun {
+		return runDryRun(tasks, opts)
+	}
+
 	workCfg, targetCfgs, err := parseConfigs(opts.Target)
 	if err != nil {
 		return err
 	}
+	overrideOutputLogs(targetCfgs, opts.OutputLogs)
+	if err := enableTracing(opts); err != nil {
+		return err
+	}
+	span := trace.StartRun("run")
+	defer func() {
+		span.End()
+		err = flushTrace(err)
+	}()
 
-	lock, err := createCacheLock(workCfg)
+	lock, err := acquireCacheLock(workCfg, opts)
 	if err != nil {
 		return err
 	}
-	if err := lock.Lock(); err != nil {
+	defer func() {
+		if unlockErr := lock.Unlock(); unlockErr != nil {
+			err = unlockErr
+		}
+	}()
+	// Signals are buffered until the executor exists, so an early interrupt still cancels the run
+	sigs := notifyInterrupts()
+
+	graph, ex, cleanup, err := createDependencyGraph(workCfg, targetCfgs, tasks, opts)
+	if err != nil {
 		return err
 	}
 	defer func() {
-		if unlockErr := lock.Unlock(); err != nil {
-			err = unlockErr
+		if cleanupErr := cleanup(); cleanupErr != nil {
+			err = cleanupErr
 		}
 	}()
-	listenForInterrupts(lock)
+	go handleInterrupts(sigs, lock, ex, opts.GracePeriod)
+	log.GraphResolved(graph.Dependencies)
+	span.SetAttribute("tasks", len(graph.Dependencies))
+
+	return graph.ExecuteTasks()
+}
+
+// Nothing is executed, outputs aren't restored, and the cache isn't written,
+// so the cache doesn't need to be locked.
+func runDryRun(tasks []string, opts Options) error {
+	workCfg, targetCfgs, err := parseConfigs(opts.Target)
+	if err != nil {
+		return err
+	}
+
+	r, err := createCacheReader(workCfg, targetCfgs, opts)
+	if err != nil {
+		return err
+	}
+
+	graph := graph.NewDependencyGraph(exec.NewPlanner(r), targetCfgs, 1)
+	if err := graph.PopulateNodes(tasks, opts.Target); err != nil {
+		return err
+	}
+	log.GraphResolved(graph.Dependencies)
 
-	graph, err := createDependencyGraph(workCfg, targetCfgs, tasks, opts)
+	return graph.ExecuteTasks()
+}
+
+// Traces are written to the profile and exported to an OpenTelemetry collector when one is configured.
+func enableTracing(opts Options) error {
+	exporters := []trace.Exporter{}
+	if opts.Profile != "" {
+		exporters = append(exporters, trace.NewChromeExporter(opts.Profile))
+	}
+
+	otlp, err := trace.NewOtlpExporterFromEnv()
 	if err != nil {
 		return err
 	}
+	if otlp != nil {
+		exporters = append(exporters, otlp)
+	}
 
-	graph.ExecuteTasks()
+	if len(exporters) > 0 {
+		trace.Enable(exporters...)
+	}
 	return nil
 }
 
-func createCacheLock(workCfg usercfg.WorkspaceConfig) (CacheLocker, error) {
-	if !workCfg.RemoteCache.Enabled {
+// Errors from exporting the trace are logged but never fail the run, e.g. when a collector is unreachable.
+func flushTrace(err error) error {
+	if traceErr := trace.Flush(); traceErr != nil {
+		log.Error(traceErr)
+	}
+	return err
+}
+
+// Runs that don't write the cache don't lock the remote cache, so they never wait on or block other runs.
+// They still lock the local cache when artifacts are downloaded to it from the remote cache.
+func acquireCacheLock(workCfg usercfg.WorkspaceConfig, opts Options) (CacheLocker, error) {
+	cacheOpts, err := parseCacheOptions(workCfg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock CacheLocker
+	switch {
+	case cacheOpts.CanWrite():
+		lock, err = createCacheLock(workCfg, cacheOpts)
+	case cacheOpts.Local && cacheOpts.Remote:
+		lock, err = sys.NewSystemLock()
+	default:
+		return nopLock{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lock, lock.Lock()
+}
+
+type nopLock struct{}
+
+func (nopLock) Lock() error {
+	return nil
+}
+
+func (nopLock) Unlock() error {
+	return nil
+}
+
+// The remote lock also covers the local cache, since every run of the workspace has to acquire it.
+// The artifact API of Turborepo and the Remote Execution API have no locks, so those remote caches use the local lock.
+func createCacheLock(workCfg usercfg.WorkspaceConfig, cacheOpts usercfg.CacheOptions) (CacheLocker, error) {
+	remoteType := workCfg.RemoteCache.Type
+	if !cacheOpts.Remote || remoteType == usercfg.RemoteCacheHttp || remoteType == usercfg.RemoteCacheReapi {
 		return sys.NewSystemLock()
 	}
+	if workCfg.RemoteCache.Type == usercfg.RemoteCacheOmni {
+		token := os.Getenv("OMNI_REMOTE_CACHE_TOKEN")
+		return server.NewServerLock(workCfg.RemoteCache.Url, token, workCfg.Name), nil
+	}
 
-	client, err := aws.NewDynamoClient(workCfg.Name, workCfg.RemoteCache.Region)
+	// Unsigned requests can't write the lock table, so anonymous credentials only work for runs that don't lock it
+	if workCfg.RemoteCache.Credentials == usercfg.CredentialsAnonymous {
+		return nil, fmt.Errorf("anonymous credentials can only read the remote cache, use --cache=read-only")
+	}
+	opts, err := createAwsClientOptions(workCfg.RemoteCache, workCfg.RemoteCache.TableEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	client, err := aws.NewDynamoClient(workCfg.Name, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -127,15 +363,24 @@ func createCacheLock(workCfg usercfg.WorkspaceConfig) (CacheLocker, error) {
 	return aws.NewAwsLock(client, workCfg.Name, workCfg.RemoteCache.Table), nil
 }
 
-func listenForInterrupts(lock CacheLocker) {
-	ch := make(chan os.Signal, 1)
+func notifyInterrupts() chan os.Signal {
+	ch := make(chan os.Signal, 2)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-	go func(lock CacheLocker) {
-		<-ch
-		if err := lock.Unlock(); err != nil {
-			log.Fatal(err)
-		}
-	}(lock)
+	return ch
+}
+
+// The first interrupt gives running tasks a grace period to exit before they're killed.
+// A second interrupt kills running tasks, releases the lock, and exits immediately.
+func handleInterrupts(ch chan os.Signal, lock CacheLocker, ex *exec.Executor, grace time.Duration) {
+	sig := <-ch
+	ex.Interrupt(sig, grace)
+
+	<-ch
+	ex.Kill()
+	if err := lock.Unlock(); err != nil {
+		log.Error(err)
+	}
+	os.Exit(ExitInterrupted)
 }
 
 func parseConfigs(dir string) (usercfg.WorkspaceConfig, map[string]usercfg.TargetConfig, error) {
@@ -157,6 +402,20 @@ func parseConfigs(dir string) (usercfg.WorkspaceConfig, map[string]usercfg.Targe
 	return workCfg, targetCfgs, nil
 }
 
+// The command line option takes priority over the output logs mode of every task.
+func overrideOutputLogs(targetCfgs map[string]usercfg.TargetConfig, mode string) {
+	if mode == "" {
+		return
+	}
+
+	for _, cfg := range targetCfgs {
+		for name, pl := range cfg.Pipeline {
+			pl.OutputLogs = mode
+			cfg.Pipeline[name] = pl
+		}
+	}
+}
+
 func parseAllTargetConfigs(dirs []string) (map[string]usercfg.TargetConfig, error) {
 	targetCfgs := make(map[string]usercfg.TargetConfig, len(dirs))
 
@@ -195,65 +454,209 @@ func createDependencyGraph(
 	targetCfgs map[string]usercfg.TargetConfig,
 	tasks []string,
 	opts Options,
-) (*graph.DependencyGraph, error) {
-	var ex graph.Executor
-	var err error
-	if workCfg.RemoteCache.Enabled {
-		ex, err = createAwsExecutor(workCfg, targetCfgs, opts.NoCache)
-	} else {
-		ex, err = createSystemExecutor(workCfg.Targets, targetCfgs, opts.NoCache)
+) (*graph.DependencyGraph, *exec.Executor, func() error, error) {
+	cacheOpts, err := parseCacheOptions(workCfg, opts)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	trans, err := createCacheTransport(workCfg, cacheOpts)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+
+	// The temporary cache directories belong to this run, so they're removed once it's finished
+	r := cache.NewCacheReader(trans, targetCfgs, workCfg.Targets, !cacheOpts.CanRead())
+	cleanup := r.Cleanup
+	var w exec.CacheWriter
+	if cacheOpts.CanWrite() {
+		cw := cache.NewCacheWriter(trans, r)
+		cleanup = func() error {
+			return errors.Join(r.Cleanup(), cw.Cleanup())
+		}
+		w = cw
+	}
+	ex := exec.NewExecutor(r, w, opts.FailFast)
+
+	concurrency, err := parseConcurrency(workCfg, opts)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	graph := graph.NewDependencyGraph(ex, targetCfgs)
+	graph := graph.NewDependencyGraph(ex, targetCfgs, concurrency)
 	if err := graph.PopulateNodes(tasks, opts.Target); err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
+	addReporters(ex, r, graph, opts)
 
-	return graph, nil
+	return graph, ex, cleanup, nil
 }
 
-func createAwsExecutor(
+// Creates a cache reader for commands that only read the cache.
+// Outputs are never restored, so hits don't download their output archives.
+func createCacheReader(
 	workCfg usercfg.WorkspaceConfig,
 	targetCfgs map[string]usercfg.TargetConfig,
-	noCache bool,
-) (graph.Executor, error) {
-	trans, err := createAwsTransport(workCfg)
+	opts Options,
+) (*cache.CacheReader, error) {
+	cacheOpts, err := parseCacheOptions(workCfg, opts)
 	if err != nil {
 		return nil, err
 	}
-
-	r := cache.NewCacheReader(trans, targetCfgs, workCfg.Targets, noCache)
-	w := cache.NewCacheWriter(trans, r)
-	if err := cache.Init(); err != nil {
+	trans, err := createCacheTransport(workCfg, cacheOpts)
+	if err != nil {
 		return nil, err
 	}
 
-	return exec.NewExecutor(r, w), nil
+	r := cache.NewCacheReader(trans, targetCfgs, workCfg.Targets, !cacheOpts.CanRead())
+	r.ValidateOnly()
+	return r, nil
 }
 
-func createSystemExecutor(
-	targets []string,
-	targetCfgs map[string]usercfg.TargetConfig,
-	noCache bool,
-) (graph.Executor, error) {
-	trans := sys.NewSystemTransport()
-	r := cache.NewCacheReader(trans, targetCfgs, targets, noCache)
-	w := cache.NewCacheWriter(trans, r)
-	if err := cache.Init(); err != nil {
+// The command line option takes priority over the workspace config.
+func parseConcurrency(workCfg usercfg.WorkspaceConfig, opts Options) (int, error) {
+	if opts.Concurrency != "" {
+		return usercfg.ParseConcurrency(opts.Concurrency)
+	}
+	return usercfg.ParseConcurrency(workCfg.Concurrency)
+}
+
+func addReporters(ex *exec.Executor, r *cache.CacheReader, graph *graph.DependencyGraph, opts Options) {
+	if opts.JUnit != "" {
+		ex.AddReporter(report.NewJUnitReporter(opts.JUnit))
+	}
+	if opts.Summary {
+		ex.AddReporter(report.NewSummaryReporter(opts.SummaryPath, r, graph.Dependencies))
+	}
+}
+
+func createCacheTransport(workCfg usercfg.WorkspaceConfig, cacheOpts usercfg.CacheOptions) (CacheTransport, error) {
+	if !cacheOpts.Remote {
+		return sys.NewSystemTransport(), nil
+	}
+
+	remote, err := createRemoteTransport(workCfg)
+	if err != nil {
 		return nil, err
 	}
+	if !cacheOpts.Local {
+		return remote, nil
+	}
+	return cache.NewLayeredTransport(sys.NewSystemTransport(), remote), nil
+}
+
+// The command line options take priority over the cache options in the workspace config, which take priority
+// over the defaults. By default, the cache is read and written, and the local cache is used along with the
+// remote cache when it's enabled. Disabling the cache with --no-cache only disables reads.
+func parseCacheOptions(workCfg usercfg.WorkspaceConfig, opts Options) (usercfg.CacheOptions, error) {
+	cacheOpts := usercfg.CacheOptions{
+		Local:  true,
+		Remote: workCfg.RemoteCache.Enabled || opts.Remote,
+		Mode:   usercfg.CacheReadWrite,
+	}
+	for _, val := range []string{workCfg.Cache, opts.Cache} {
+		if val == "" {
+			continue
+		}
+		override, err := usercfg.ParseCacheOptions(val)
+		if err != nil {
+			return usercfg.CacheOptions{}, err
+		}
+		if override.Local || override.Remote {
+			cacheOpts.Local, cacheOpts.Remote = override.Local, override.Remote
+		}
+		if override.Mode != "" {
+			cacheOpts.Mode = override.Mode
+		}
+	}
 
-	return exec.NewExecutor(r, w), nil
+	if opts.NoCache {
+		switch cacheOpts.Mode {
+		case usercfg.CacheReadWrite:
+			cacheOpts.Mode = usercfg.CacheWriteOnly
+		case usercfg.CacheReadOnly:
+			cacheOpts.Mode = usercfg.CacheOff
+		}
+	}
+
+	// Runs that neither read nor write the cache never connect to the remote cache, so it needn't be reachable
+	if cacheOpts.Mode == usercfg.CacheOff {
+		cacheOpts.Remote = false
+	}
+	if cacheOpts.Remote {
+		if err := workCfg.RemoteCache.Validate(); err != nil {
+			return usercfg.CacheOptions{}, err
+		}
+	}
+	return cacheOpts, nil
+}
+
+func createRemoteTransport(workCfg usercfg.WorkspaceConfig) (CacheTransport, error) {
+	// Cache servers serve the artifact API of Turborepo
+	switch workCfg.RemoteCache.Type {
+	case usercfg.RemoteCacheHttp:
+		// Turborepo expects artifacts to never change, and nothing locks the indexes that every run rewrites
+		return cache.NewImmutableTransport(createTurboTransport(workCfg)), nil
+	case usercfg.RemoteCacheOmni:
+		return createTurboTransport(workCfg), nil
+	case usercfg.RemoteCacheReapi:
+		// The Action Cache only stores the results of tasks by fingerprint, so the indexes stay local
+		transport, err := createReapiTransport(workCfg)
+		if err != nil {
+			return nil, err
+		}
+		return cache.NewImmutableTransport(transport), nil
+	}
+	return createAwsTransport(workCfg)
+}
+
+// The token is read from the environment, so that it isn't committed with the workspace config.
+func createTurboTransport(workCfg usercfg.WorkspaceConfig) *turbo.TurboTransport {
+	token := os.Getenv("OMNI_REMOTE_CACHE_TOKEN")
+	return turbo.NewTurboTransport(workCfg.RemoteCache.Url, token, workCfg.RemoteCache.Team, workCfg.Name)
+}
+
+func createReapiTransport(workCfg usercfg.WorkspaceConfig) (*reapi.ReapiTransport, error) {
+	token := os.Getenv("OMNI_REMOTE_CACHE_TOKEN")
+	conn, err := reapi.NewReapiClient(workCfg.RemoteCache.Url, token)
+	if err != nil {
+		return nil, err
+	}
+	return reapi.NewReapiTransport(conn, workCfg.RemoteCache.Instance), nil
 }
 
 func createAwsTransport(workCfg usercfg.WorkspaceConfig) (*aws.AwsTransport, error) {
-	s3Client, err := aws.NewS3Client(workCfg.Name, workCfg.RemoteCache.Region)
+	opts, err := createAwsClientOptions(workCfg.RemoteCache, workCfg.RemoteCache.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	s3Client, err := aws.NewS3Client(workCfg.Name, opts)
 	if err != nil {
 		return nil, err
 	}
 	trans := aws.NewAwsTransport(s3Client, workCfg.Name, workCfg.RemoteCache.Bucket)
 	return trans, nil
 }
+
+// Static credentials are read from the environment, so that they aren't committed with the workspace config.
+func createAwsClientOptions(cfg usercfg.RemoteCacheConfig, endpoint string) (aws.ClientOptions, error) {
+	opts := aws.ClientOptions{
+		Region:         cfg.Region,
+		Endpoint:       endpoint,
+		ForcePathStyle: cfg.ForcePathStyle,
+		Profile:        cfg.Profile,
+		RoleArn:        cfg.RoleArn,
+		Anonymous:      cfg.Credentials == usercfg.CredentialsAnonymous,
+	}
+
+	if cfg.Credentials == usercfg.CredentialsStatic {
+		opts.AccessKeyId = os.Getenv("OMNI_REMOTE_CACHE_ACCESS_KEY_ID")
+		opts.SecretAccessKey = os.Getenv("OMNI_REMOTE_CACHE_SECRET_ACCESS_KEY")
+		opts.SessionToken = os.Getenv("OMNI_REMOTE_CACHE_SESSION_TOKEN")
+		if opts.AccessKeyId == "" || opts.SecretAccessKey == "" {
+			return aws.ClientOptions{}, fmt.Errorf(
+				"OMNI_REMOTE_CACHE_ACCESS_KEY_ID and OMNI_REMOTE_CACHE_SECRET_ACCESS_KEY must be set to use static credentials",
+			)
+		}
+	}
+	return opts, nil
+}
@@ -15,11 +15,39 @@ type TargetConfig struct {
 }
 
 type PipelineConfig struct {
-	Command   string   `yaml:"command"`
-	DependsOn []string `yaml:"dependsOn"`
-	Includes  []string `yaml:"includes"`
-	Excludes  []string `yaml:"excludes"`
-	Outputs   []string `yaml:"outputs"`
+	Command    string   `yaml:"command"`
+	DependsOn  []string `yaml:"dependsOn"`
+	Env        []string `yaml:"env"`
+	Includes   []string `yaml:"includes"`
+	Excludes   []string `yaml:"excludes"`
+	Outputs    []string `yaml:"outputs"`
+	OutputLogs string   `yaml:"outputLogs"`
+}
+
+// Determines which task logs are printed.
+const (
+	// Logs are printed for every task (default)
+	FullLogs = "full"
+	// Only the cache status and fingerprint are printed for every task
+	HashOnlyLogs = "hash-only"
+	// Logs are printed for cache misses, and only the cache status and fingerprint are printed for cache hits
+	NewOnlyLogs = "new-only"
+	// Logs are printed for failed tasks only
+	ErrorsOnlyLogs = "errors-only"
+	// Nothing is printed
+	NoLogs = "none"
+)
+
+func ValidateOutputLogs(mode string) error {
+	switch mode {
+	case "", FullLogs, HashOnlyLogs, NewOnlyLogs, ErrorsOnlyLogs, NoLogs:
+		return nil
+	default:
+		return fmt.Errorf(
+			"invalid output logs mode %q, expected one of %q, %q, %q, %q, or %q",
+			mode, FullLogs, HashOnlyLogs, NewOnlyLogs, ErrorsOnlyLogs, NoLogs,
+		)
+	}
 }
 
 func NewTargetConfig(dir string) (TargetConfig, error) {
@@ -38,5 +66,11 @@ func NewTargetConfig(dir string) (TargetConfig, error) {
 		return TargetConfig{}, fmt.Errorf("failed to parse %q: %v", path, err)
 	}
 
+	for name, pl := range cfg.Pipeline {
+		if err := ValidateOutputLogs(pl.OutputLogs); err != nil {
+			return TargetConfig{}, fmt.Errorf("failed to parse %q: task %q: %v", path, name, err)
+		}
+	}
+
 	return cfg, nil
 }
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -11,14 +14,93 @@ import (
 type WorkspaceConfig struct {
 	Name        string            `yaml:"name"`
 	Targets     []string          `yaml:"targets"`
+	Concurrency string            `yaml:"concurrency"`
+	Cache       string            `yaml:"cache"`
 	RemoteCache RemoteCacheConfig `yaml:"remoteCache"`
 }
 
+// Types of remote caches.
+const (
+	RemoteCacheS3   = "s3"
+	RemoteCacheHttp = "http"
+	// A cache server started with `omni cache serve`, which also provides locks
+	RemoteCacheOmni = "omni"
+	// A cache that implements the Action Cache and CAS of the Remote Execution API
+	RemoteCacheReapi = "reapi"
+)
+
+// Sources of credentials for S3 and DynamoDB.
+const (
+	// The default credential chain of the AWS SDK
+	CredentialsDefault = "default"
+	// An access key read from the OMNI_REMOTE_CACHE_ACCESS_KEY_ID and OMNI_REMOTE_CACHE_SECRET_ACCESS_KEY environment variables
+	CredentialsStatic = "static"
+	// Unsigned requests, e.g. to read public buckets
+	CredentialsAnonymous = "anonymous"
+)
+
 type RemoteCacheConfig struct {
-	Enabled bool   `yaml:"enabled"`
-	Bucket  string `yaml:"bucket"`
-	Table   string `yaml:"table"`
-	Region  string `yaml:"region"`
+	Enabled bool `yaml:"enabled"`
+	// Either "s3" (default), "http", "omni", or "reapi"
+	Type   string `yaml:"type"`
+	Bucket string `yaml:"bucket"`
+	Table  string `yaml:"table"`
+	Region string `yaml:"region"`
+	// The URLs of S3 and DynamoDB compatible services, e.g. MinIO and DynamoDB Local
+	Endpoint      string `yaml:"endpoint"`
+	TableEndpoint string `yaml:"tableEndpoint"`
+	// Addresses buckets by path instead of by subdomain
+	ForcePathStyle bool   `yaml:"forcePathStyle"`
+	Profile        string `yaml:"profile"`
+	RoleArn        string `yaml:"roleArn"`
+	// Either "default", "static", or "anonymous"
+	Credentials string `yaml:"credentials"`
+	// The base URL of a Turborepo remote cache or cache server, when the type is "http" or "omni",
+	// or a grpc:// or grpcs:// URL when the type is "reapi"
+	Url  string `yaml:"url"`
+	Team string `yaml:"team"`
+	// The instance name of a Remote Execution API cache, which may be empty
+	Instance string `yaml:"instance"`
+}
+
+// Checks that the options required by the type of the remote cache are defined.
+func (cfg RemoteCacheConfig) Validate() error {
+	switch cfg.Type {
+	case "", RemoteCacheS3:
+		if cfg.Bucket == "" {
+			return fmt.Errorf("bucket name is not defined in workspace config")
+		}
+		if cfg.Table == "" {
+			return fmt.Errorf("table name is not defined in workspace config")
+		}
+		return cfg.validateCredentials()
+	case RemoteCacheHttp, RemoteCacheOmni, RemoteCacheReapi:
+		if cfg.Url == "" {
+			return fmt.Errorf("remote cache url is not defined in workspace config")
+		}
+	default:
+		return fmt.Errorf(
+			"invalid remote cache type %q, expected %q, %q, %q, or %q",
+			cfg.Type, RemoteCacheS3, RemoteCacheHttp, RemoteCacheOmni, RemoteCacheReapi,
+		)
+	}
+	return nil
+}
+
+func (cfg RemoteCacheConfig) validateCredentials() error {
+	switch cfg.Credentials {
+	case "", CredentialsDefault, CredentialsStatic:
+	case CredentialsAnonymous:
+		if cfg.RoleArn != "" {
+			return fmt.Errorf("a role cannot be assumed with anonymous credentials")
+		}
+	default:
+		return fmt.Errorf(
+			"invalid remote cache credentials %q, expected %q, %q, or %q",
+			cfg.Credentials, CredentialsDefault, CredentialsStatic, CredentialsAnonymous,
+		)
+	}
+	return nil
 }
 
 func NewWorkspaceConfig() (WorkspaceConfig, error) {
@@ -44,14 +126,118 @@ func validateWorkspaceConfig(cfg WorkspaceConfig) error {
 	if cfg.Name == "" {
 		return errors.New("workspace name is not defined in config")
 	}
+	if _, err := ParseConcurrency(cfg.Concurrency); err != nil {
+		return err
+	}
+	if cfg.Cache != "" {
+		if _, err := ParseCacheOptions(cfg.Cache); err != nil {
+			return err
+		}
+	}
 	if !cfg.RemoteCache.Enabled {
 		return nil
 	}
-	if cfg.RemoteCache.Bucket == "" {
-		return fmt.Errorf("bucket name is not defined in workspace config")
+	return cfg.RemoteCache.Validate()
+}
+
+// Parses the maximum number of tasks that can run at the same time.
+// The value can be either a positive integer or a percentage of the available CPUs (e.g. "50%").
+// An empty value defaults to the number of available CPUs.
+func ParseConcurrency(val string) (int, error) {
+	if val == "" {
+		return runtime.NumCPU(), nil
+	}
+
+	if percent, ok := strings.CutSuffix(val, "%"); ok {
+		n, err := strconv.ParseFloat(percent, 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid concurrency %q, percentages must be greater than 0%%", val)
+		}
+		return max(1, int(float64(runtime.NumCPU())*n/100)), nil
 	}
-	if cfg.RemoteCache.Table == "" {
-		return fmt.Errorf("table name is not defined in workspace config")
+
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid concurrency %q, must be a positive integer or percentage", val)
 	}
-	return nil
+	return n, nil
+}
+
+// Modes that determine whether a run reads from and writes to the cache.
+const (
+	CacheReadWrite = "read-write"
+	CacheReadOnly  = "read-only"
+	CacheWriteOnly = "write-only"
+	CacheOff       = "off"
+)
+
+// Determines which caches a run uses, and how it uses them.
+type CacheOptions struct {
+	Local  bool
+	Remote bool
+	Mode   string
+}
+
+// Reports whether cache entries are looked up, so that tasks can be replayed from the cache.
+func (o CacheOptions) CanRead() bool {
+	return o.Mode == CacheReadWrite || o.Mode == CacheReadOnly
+}
+
+// Reports whether the results of executed tasks are written to the cache.
+func (o CacheOptions) CanWrite() bool {
+	return o.Mode == CacheReadWrite || o.Mode == CacheWriteOnly
+}
+
+// Parses a comma-separated list of caches and at most one mode, e.g. "remote,read-only".
+// The caches are both false and the mode is empty when they aren't in the list.
+func ParseCacheOptions(val string) (CacheOptions, error) {
+	opts := CacheOptions{}
+	for _, item := range strings.Split(val, ",") {
+		switch item = strings.TrimSpace(item); item {
+		case "local":
+			opts.Local = true
+		case "remote":
+			opts.Remote = true
+		case CacheReadWrite, CacheReadOnly, CacheWriteOnly, CacheOff:
+			if opts.Mode != "" {
+				return CacheOptions{}, fmt.Errorf("invalid cache %q, only one mode can be used", val)
+			}
+			opts.Mode = item
+		default:
+			return CacheOptions{}, fmt.Errorf(
+				"invalid cache %q, expected a list of \"local\" or \"remote\", and one of %q, %q, %q, or %q",
+				val, CacheReadWrite, CacheReadOnly, CacheWriteOnly, CacheOff,
+			)
+		}
+	}
+	return opts, nil
+}
+
+var sizeUnits = map[string]int64{
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// Parses a size in bytes, which can have a KB, MB, GB, or TB suffix (e.g. "10GB").
+// An empty value is parsed as 0.
+func ParseSize(val string) (int64, error) {
+	if val == "" {
+		return 0, nil
+	}
+
+	num, unit := val, int64(1)
+	for suffix, n := range sizeUnits {
+		if trimmed, ok := strings.CutSuffix(strings.ToUpper(val), suffix); ok {
+			num, unit = trimmed, n
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, must be a positive number of bytes, KB, MB, GB, or TB", val)
+	}
+	return n * unit, nil
 }